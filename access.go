@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessIndex records when cached files were last served, and how many
+// times, independently of file system access times (which are often not
+// updated, because of noatime or relatime mount options, or are unreliable,
+// i.e. on NFS). Used by GC and eviction.
+//
+// It is kept in memory, and saved periodically to cache/REPO/access/index,
+// so it survives restarts. Hits since the last save are lost on crash,
+// which only makes GC a bit less accurate.
+//
+// File format is a header line, then for each file: uvarint length of the
+// filename, filename (relative to final/), varint last access time (unix
+// seconds), uvarint hit count.
+type accessIndex struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]accessEntry
+	dirty   bool
+}
+
+type accessEntry struct {
+	lastAccess int64
+	hits       uint64
+}
+
+const accessIndexHeader = "nexus-proxy access index 1\n"
+
+func accessIndexPath(reponame string) string {
+	return "cache/" + reponame + "/access/index"
+}
+
+// loadAccessIndex reads the index of the repo. Missing file is an empty
+// index.
+func loadAccessIndex(reponame string) (*accessIndex, error) {
+	index := &accessIndex{
+		path:    accessIndexPath(reponame),
+		entries: make(map[string]accessEntry),
+	}
+	f, err := os.Open(index.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil || header != accessIndexHeader {
+		return index, fmt.Errorf("Invalid header of access index %q", index.path)
+	}
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil || length > 4096 {
+			return index, fmt.Errorf("Access index %q corrupted after %d entries", index.path, len(index.entries))
+		}
+		name := make([]byte, length)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return index, fmt.Errorf("Access index %q truncated after %d entries", index.path, len(index.entries))
+		}
+		lastAccess, err := binary.ReadVarint(r)
+		if err != nil {
+			return index, fmt.Errorf("Access index %q truncated after %d entries", index.path, len(index.entries))
+		}
+		hits, err := binary.ReadUvarint(r)
+		if err != nil {
+			return index, fmt.Errorf("Access index %q truncated after %d entries", index.path, len(index.entries))
+		}
+		index.entries[string(name)] = accessEntry{lastAccess: lastAccess, hits: hits}
+	}
+}
+
+// record marks the file as served now.
+func (index *accessIndex) record(filename string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	entry := index.entries[filename]
+	entry.lastAccess = time.Now().Unix()
+	entry.hits++
+	index.entries[filename] = entry
+	index.dirty = true
+}
+
+// lastAccess returns when the file was last served, if known.
+func (index *accessIndex) lastAccess(filename string) (time.Time, bool) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	entry, ok := index.entries[filename]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(entry.lastAccess, 0), true
+}
+
+// size returns number of files in the index.
+func (index *accessIndex) size() int {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return len(index.entries)
+}
+
+// prune removes entries of files which were not seen in the cache by a scan
+// started at scanStart, and were not accessed since then.
+func (index *accessIndex) prune(seen map[string]bool, scanStart time.Time) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	for filename, entry := range index.entries {
+		if !seen[filename] && entry.lastAccess < scanStart.Unix() {
+			delete(index.entries, filename)
+			index.dirty = true
+		}
+	}
+}
+
+// save writes the index to disk, if it changed since the last save.
+func (index *accessIndex) save() error {
+	index.mu.Lock()
+	if !index.dirty {
+		index.mu.Unlock()
+		return nil
+	}
+	var buf []byte
+	buf = append(buf, accessIndexHeader...)
+	for filename, entry := range index.entries {
+		buf = binary.AppendUvarint(buf, uint64(len(filename)))
+		buf = append(buf, filename...)
+		buf = binary.AppendVarint(buf, entry.lastAccess)
+		buf = binary.AppendUvarint(buf, entry.hits)
+	}
+	index.dirty = false
+	index.mu.Unlock()
+
+	temp := index.path + ".new"
+	err := os.WriteFile(temp, buf, 0640)
+	if err == nil {
+		err = os.Rename(temp, index.path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		index.mu.Lock()
+		index.dirty = true
+		index.mu.Unlock()
+	}
+	return err
+}
+
+// saveAccessIndexes saves access indexes of all repos, which changed.
+func saveAccessIndexes(repos map[string]*Repo) {
+	for reponame, repo := range repos {
+		if err := repo.access.save(); err != nil {
+			error_count.Inc()
+			log.Printf("access: Failed to save access index of %s. Error: %v", reponame, err)
+		}
+		access_index_entries.WithLabelValues(reponame).Set(float64(repo.access.size()))
+	}
+}
+
+// startAccessIndexLoop periodically saves access indexes of all repos. If
+// interval is 0, they are saved only by GC loop after GC and eviction, and
+// on stop.
+func startAccessIndexLoop(repos map[string]*Repo, interval time.Duration) chan bool {
+	stopChan := make(chan bool, 1)
+	go func() {
+		// Never ready, if periodic saving is disabled.
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				saveAccessIndexes(repos)
+			case <-stopChan:
+				saveAccessIndexes(repos)
+				return
+			}
+		}
+	}()
+	return stopChan
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("Circuit breaker open, upstream is failing")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops requests to a failing upstream, so clients fail fast
+// instead of waiting for timeouts.
+//
+// When closed, requests and failures are counted over a window. If error
+// rate reaches the threshold (with at least minimum number of requests),
+// breaker opens, and no requests are made. After a while breaker becomes
+// half-open, and lets a single request through. If it succeeds, breaker
+// closes, otherwise opens again.
+//
+// A nil *circuitBreaker is always closed.
+type circuitBreaker struct {
+	option   CircuitBreakerOption
+	reponame string
+	base     string
+
+	mu          sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(option CircuitBreakerOption, reponame, base string) *circuitBreaker {
+	b := &circuitBreaker{
+		option:      option,
+		reponame:    reponame,
+		base:        base,
+		windowStart: time.Now(),
+	}
+	upstream_circuit_state.WithLabelValues(reponame, base).Set(float64(circuitClosed))
+	return b
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	if b.state == state {
+		return
+	}
+	log.Printf("upstream: %s %q circuit breaker %s (was %s)", b.reponame, b.base, state, b.state)
+	b.state = state
+	upstream_circuit_state.WithLabelValues(b.reponame, b.base).Set(float64(state))
+	switch state {
+	case circuitOpen:
+		circuit_open_count.Inc()
+		b.openedAt = time.Now()
+	case circuitClosed:
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.failures = 0
+	}
+}
+
+// allow returns true, if a request can be made now. If it returns true,
+// the result of the request must be recorded using record.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.option.OpenFor {
+		b.setState(circuitHalfOpen)
+	}
+	switch b.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if success {
+			b.setState(circuitClosed)
+		} else {
+			b.setState(circuitOpen)
+		}
+	case circuitClosed:
+		if time.Since(b.windowStart) >= b.option.Window {
+			b.windowStart = time.Now()
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.option.MinRequests && float64(b.failures) >= b.option.ErrorRate*float64(b.requests) {
+			b.setState(circuitOpen)
+		}
+	}
+}
+
+// isOpen returns true, if requests are currently not allowed. Unlike allow,
+// it does not start a half-open probe.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.option.OpenFor
+}
+
+func (b *circuitBreaker) getState() circuitState {
+	if b == nil {
+		return circuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// circuitOpen returns true, if circuit breakers of all upstream URLs
+// (mirrors) of the repo are open.
+func (repo *Repo) circuitOpen() bool {
+	for _, u := range repo.upstreams {
+		if !u.breaker.isOpen() {
+			return false
+		}
+	}
+	return true
+}
+
+// circuitRetryAfter returns time after which a request to upstream of the
+// repo might be allowed again.
+func (repo *Repo) circuitRetryAfter() time.Duration {
+	retryAfter := time.Duration(0)
+	for i, u := range repo.upstreams {
+		if u.breaker == nil {
+			return 0
+		}
+		u.breaker.mu.Lock()
+		remaining := u.breaker.option.OpenFor - time.Since(u.breaker.openedAt)
+		u.breaker.mu.Unlock()
+		if i == 0 || remaining < retryAfter {
+			retryAfter = remaining
+		}
+	}
+	if retryAfter < 0 {
+		return 0
+	}
+	return retryAfter
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testCircuitBreaker(base string) *circuitBreaker {
+	return newCircuitBreaker(CircuitBreakerOption{
+		ErrorRate:   0.5,
+		MinRequests: 2,
+		Window:      time.Minute,
+		OpenFor:     time.Hour,
+	}, "test", base)
+}
+
+// tripCircuitBreaker opens the breaker, with OpenFor already elapsed, so
+// the next allow starts a half-open probe.
+func tripCircuitBreaker(t *testing.T, b *circuitBreaker) {
+	t.Helper()
+	for i := 0; i < b.option.MinRequests; i++ {
+		if !b.allow() {
+			t.Fatalf("allow() = false before breaker opened")
+		}
+		b.record(false)
+	}
+	if got := b.getState(); got != circuitOpen {
+		t.Fatalf("state after failures = %s, want open", got)
+	}
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.option.OpenFor)
+	b.mu.Unlock()
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := testCircuitBreaker("http://a/")
+	b.record(true)
+	b.record(true)
+	b.record(false)
+	if got := b.getState(); got != circuitClosed {
+		t.Fatalf("state at error rate 0.33 = %s, want closed", got)
+	}
+	b.record(false)
+	if got := b.getState(); got != circuitOpen {
+		t.Fatalf("state at error rate 0.5 = %s, want open", got)
+	}
+	if b.allow() {
+		t.Fatalf("allow() = true while open")
+	}
+	if !b.isOpen() {
+		t.Fatalf("isOpen() = false while open")
+	}
+
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.option.OpenFor)
+	b.mu.Unlock()
+	if b.isOpen() {
+		t.Fatalf("isOpen() = true after OpenFor")
+	}
+	if !b.allow() {
+		t.Fatalf("allow() = false for half-open probe")
+	}
+	if got := b.getState(); got != circuitHalfOpen {
+		t.Fatalf("state after OpenFor = %s, want half-open", got)
+	}
+	if b.allow() {
+		t.Fatalf("allow() = true for second half-open probe")
+	}
+	b.record(false)
+	if got := b.getState(); got != circuitOpen {
+		t.Fatalf("state after failed probe = %s, want open", got)
+	}
+
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.option.OpenFor)
+	b.mu.Unlock()
+	if !b.allow() {
+		t.Fatalf("allow() = false for half-open probe")
+	}
+	b.record(true)
+	if got := b.getState(); got != circuitClosed {
+		t.Fatalf("state after successful probe = %s, want closed", got)
+	}
+	if !b.allow() {
+		t.Fatalf("allow() = false after closing")
+	}
+}
+
+func TestCircuitBreakerNil(t *testing.T) {
+	var b *circuitBreaker
+	if !b.allow() || b.isOpen() || b.getState() != circuitClosed {
+		t.Fatalf("nil breaker is not always closed")
+	}
+	b.record(false)
+}
+
+// Half-open mirrors which are not tried, because an earlier one succeeded,
+// must not be left with their probe taken.
+func TestDoUpstreamHalfOpenMirrorNotTried(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	repo := &Repo{client: &http.Client{}}
+	for _, base := range []string{first.URL + "/", second.URL + "/"} {
+		u := newUpstream("test", base)
+		u.breaker = testCircuitBreaker(base)
+		tripCircuitBreaker(t, u.breaker)
+		repo.upstreams = append(repo.upstreams, u)
+	}
+
+	resp, err := repo.doUpstream(http.MethodGet, "file", nil)
+	if err != nil {
+		t.Fatalf("doUpstream error: %v", err)
+	}
+	resp.Body.Close()
+	if got := repo.upstreams[0].breaker.getState(); got != circuitClosed {
+		t.Errorf("first mirror state = %s, want closed", got)
+	}
+	if !repo.upstreams[1].breaker.allow() {
+		t.Errorf("second mirror does not allow a probe, after not being tried")
+	}
+	repo.upstreams[1].breaker.record(true)
+
+	// First mirror fails again, second one is used.
+	first.Close()
+	tripCircuitBreaker(t, repo.upstreams[0].breaker)
+	repo.upstreams[0].breaker.mu.Lock()
+	repo.upstreams[0].breaker.openedAt = time.Now()
+	repo.upstreams[0].breaker.mu.Unlock()
+	resp, err = repo.doUpstream(http.MethodGet, "file", nil)
+	if err != nil {
+		t.Fatalf("doUpstream with first mirror open error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.String() != second.URL+"/file" {
+		t.Errorf("doUpstream used %q, want second mirror", resp.Request.URL)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cleanup of files and directories not handled by GC. Temporary files are
+// normally removed when the download finishes, or kept as partial downloads
+// for resuming, but they can be left behind by a crash (files created using
+// os.CreateTemp fallback, see tempfile.go), or never resumed. Directories in
+// final/ and meta/ are left empty, when all files in them are removed.
+
+// cleanTemp removes files in cache/REPO/temp/ not modified for longer than
+// maxAge. Returns number of files removed.
+func cleanTemp(reponame string, maxAge time.Duration) int {
+	dir := "cache/" + reponame + "/temp"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		gc_error_count.Inc()
+		log.Printf("cleanup: Error listing %q: %v", dir, err)
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := dir + "/" + entry.Name()
+		fi, err := entry.Info()
+		if err != nil || time.Since(fi.ModTime()) <= maxAge {
+			continue
+		}
+		if strings.HasSuffix(path, ".partial.json") {
+			if _, err := os.Stat(strings.TrimSuffix(path, ".json")); err == nil {
+				// Removed together with the data.
+				continue
+			}
+		}
+		if strings.HasSuffix(path, ".partial") {
+			if !removeStalePartial(path) {
+				continue
+			}
+		} else if err := os.Remove(path); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				gc_error_count.Inc()
+				log.Printf("cleanup: Error removing %q: %v", path, err)
+			}
+			continue
+		}
+		log.Printf("cleanup: Removed stale temporary file %q (%d bytes, modified %s ago)", path, fi.Size(), time.Since(fi.ModTime()))
+		removed++
+		temp_removed_count.Inc()
+	}
+	return removed
+}
+
+// removeStalePartial removes partial download and its progress record,
+// unless it is being resumed right now (see loadPartial).
+func removeStalePartial(path string) bool {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) != nil {
+		return false
+	}
+	os.Remove(path + ".json")
+	if err := os.Remove(path); err != nil {
+		gc_error_count.Inc()
+		log.Printf("cleanup: Error removing %q: %v", path, err)
+		return false
+	}
+	return true
+}
+
+// pruneEmptyDirs removes empty directories below dir (but not dir itself),
+// deepest first, so directories containing only empty directories are
+// removed too. Returns number of directories removed.
+func (repo *Repo) pruneEmptyDirs(dir string) int {
+	var dirs []string
+	// Number of entries in each directory, as seen by the walk.
+	entries := make(map[string]int)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		entries[filepath.Dir(path)]++
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		gc_error_count.Inc()
+		log.Printf("cleanup: Error walking %q: %v", dir, err)
+		return 0
+	}
+	removed := 0
+	// Subdirectories are walked after their parent.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := dirs[i]
+		if entries[path] > 0 {
+			continue
+		}
+		// Fails, if a file was put in it since the walk. Fetches hold the
+		// lock from creating directories, until the file is in place.
+		repo.dirMu.Lock()
+		err := syscall.Rmdir(path)
+		repo.dirMu.Unlock()
+		if err != nil {
+			if err != syscall.ENOTEMPTY && err != syscall.EEXIST && err != syscall.ENOENT {
+				gc_error_count.Inc()
+				log.Printf("cleanup: Error removing directory %q: %v", path, err)
+			}
+			continue
+		}
+		entries[filepath.Dir(path)]--
+		removed++
+		empty_dirs_removed_count.Inc()
+	}
+	return removed
+}
+
+// startCleanupLoop removes stale temporary files and empty directories of
+// all repos, on startup, and then periodically, unless interval is 0.
+func startCleanupLoop(repos map[string]*Repo, interval time.Duration) chan bool {
+	cleanAll := func() {
+		for reponame, repo := range repos {
+			t1 := time.Now()
+			tempRemoved := cleanTemp(reponame, *tempMaxAge)
+			dirsRemoved := repo.pruneEmptyDirs("cache/"+reponame+"/final") + repo.pruneEmptyDirs("cache/"+reponame+"/meta")
+			log.Printf("cleanup: %s finished in %s. %d stale temporary files and %d empty directories removed.", reponame, time.Since(t1), tempRemoved, dirsRemoved)
+		}
+	}
+
+	stopChan := make(chan bool, 1)
+	go func() {
+		cleanAll()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				cleanAll()
+			case <-stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return stopChan
+}
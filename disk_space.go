@@ -7,7 +7,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func update_free_disk_space() {
+// update_free_disk_space updates disk space metrics. Returns available and
+// total space in bytes (0 if not known).
+func update_free_disk_space() (available, total int64) {
 	var stat unix.Statfs_t
 	wd, err := os.Getwd()
 	if err != nil {
@@ -17,5 +19,7 @@ func update_free_disk_space() {
 		disk_cache_available_space_bytes.Set(float64(stat.Bavail * uint64(stat.Bsize)))
 		disk_cache_used_space_bytes.Set(float64((stat.Blocks - stat.Bfree) * uint64(stat.Bsize)))
 		disk_cache_total_space_bytes.Set(float64(stat.Blocks * uint64(stat.Bsize)))
+		available, total = int64(stat.Bavail*uint64(stat.Bsize)), int64(stat.Blocks*uint64(stat.Bsize))
 	}
+	return available, total
 }
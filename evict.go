@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Size based eviction. When cache of a repo exceeds its quota (--cache_quota),
+// all repos exceed --global_cache_quota, or available disk space is below
+// --min_free_disk_space, least recently used files are removed. Runs in the
+// GC loop, periodically, or when requested by cache misses (requestEviction).
+
+// Files in cache/*/final/ of all repos, approximately. Set by eviction scan,
+// and increased when files are added to the cache.
+var totalCacheBytes atomic.Int64
+
+// Eviction requests from cache misses, see requestEviction.
+var evictionRequests = make(chan struct{}, 1)
+
+// Scanning the whole cache is expensive, so do not do it more often, even if
+// requested.
+const minEvictionInterval = 10 * time.Second
+
+type cachedFile struct {
+	repo     *Repo
+	reponame string
+	// Relative to final/.
+	filename string
+	size     int64
+	lastUse  time.Time
+}
+
+// requestEviction asks the GC loop to run eviction soon. Does not block.
+func requestEviction() {
+	select {
+	case evictionRequests <- struct{}{}:
+	default:
+	}
+}
+
+// cacheAdded accounts a file added to the cache of the repo, and requests
+// eviction if any quota is exceeded. Low disk space is checked after every
+// fetch.
+func (repo *Repo) cacheAdded(size int64) {
+	repoBytes := repo.cacheBytes.Add(size)
+	globalBytes := totalCacheBytes.Add(size)
+	if aboveHighWatermark(repoBytes, repo.cacheQuota) || aboveHighWatermark(globalBytes, int64(*globalCacheQuota)) {
+		requestEviction()
+	}
+}
+
+func aboveHighWatermark(size, quota int64) bool {
+	return quota > 0 && float64(size) > float64(quota)**quotaHighWatermark
+}
+
+func lowDiskSpace(available, total int64) bool {
+	return *minFreeDiskSpace > 0 && total > 0 && available < int64(*minFreeDiskSpace)
+}
+
+// lastUse is the time file was last put in the cache (or revalidated) or
+// served. Access time of the file is used only if the file is not in the
+// access index (i.e. cached before it existed).
+func (repo *Repo) lastUse(filename string, fi os.FileInfo) time.Time {
+	lastUse := fi.ModTime()
+	times := []time.Time{repo.lastAccess(filename, fi)}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat != nil {
+		times = append(times, time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)))
+	}
+	for _, t := range times {
+		if t.After(lastUse) {
+			lastUse = t
+		}
+	}
+	return lastUse
+}
+
+// lastAccess is the time file was last served, from the access index, or
+// file access time if not known.
+func (repo *Repo) lastAccess(filename string, fi os.FileInfo) time.Time {
+	if t, ok := repo.access.lastAccess(filename); ok {
+		return t
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat != nil {
+		return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	}
+	return time.Time{}
+}
+
+// listCachedFiles returns files in the cache of the repo, which can be
+// evicted, and total size of all files (including ones which cannot be
+// evicted, see cachePolicy).
+func listCachedFiles(reponame string, repo *Repo) ([]cachedFile, int64, error) {
+	var files []cachedFile
+	var total int64
+	finalPrefix := "cache/" + reponame + "/final/"
+	seen := make(map[string]bool)
+	scanStart := time.Now()
+	err := filepath.WalkDir("cache/"+reponame+"/final", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if d.Name() == "vary" && strings.HasSuffix(filepath.Dir(path), varyDirSuffix) {
+			// Needed to find variants, see vary.go.
+			return nil
+		}
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += fi.Size()
+		filename := strings.TrimPrefix(path, finalPrefix)
+		seen[filename] = true
+		if !repo.cachePolicy(filename).canRemove(fi.ModTime()) {
+			return nil
+		}
+		files = append(files, cachedFile{
+			repo:     repo,
+			reponame: reponame,
+			filename: filename,
+			size:     fi.Size(),
+			lastUse:  repo.lastUse(filename, fi),
+		})
+		return nil
+	})
+	if err == nil {
+		repo.access.prune(seen, scanStart)
+	}
+	return files, total, err
+}
+
+// evictFiles removes least recently used files, until toFree bytes are
+// freed. Returns remaining files, and files which were evicted.
+func evictFiles(files []cachedFile, toFree int64, reason string) (remaining, evicted []cachedFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].lastUse.Before(files[j].lastUse)
+	})
+	var freed int64
+	i := 0
+	for ; i < len(files) && freed < toFree; i++ {
+		file := files[i]
+		path := "cache/" + file.reponame + "/final/" + file.filename
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				gc_error_count.Inc()
+				log.Printf("gc: Failed to evict %q. Error: %v", path, err)
+				remaining = append(remaining, file)
+			}
+			continue
+		}
+		removeCacheMeta(file.reponame, file.filename)
+		if original := variantOf(file.filename); original != file.filename {
+			file.repo.removeUnusedVary(file.reponame, original)
+		}
+		freed += file.size
+		evicted = append(evicted, file)
+		evicted_count.Inc()
+		evicted_bytes.Add(float64(file.size))
+		log.Printf("gc: Evicted %q (%d bytes, last used %s ago), %s", path, file.size, time.Since(file.lastUse), reason)
+	}
+	return append(remaining, files[i:]...), evicted
+}
+
+// evictionEnabled returns true if any quota or minimum free disk space is
+// set.
+func evictionEnabled(repos map[string]*Repo) bool {
+	if *globalCacheQuota > 0 || *minFreeDiskSpace > 0 {
+		return true
+	}
+	for _, repo := range repos {
+		if repo.cacheQuota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runEviction evicts files from repos over their quota, then from all repos
+// if over global quota, or disk space is low.
+func runEviction(repos map[string]*Repo) {
+	t1 := time.Now()
+	byRepo := make(map[string][]cachedFile)
+	sizes := make(map[string]int64)
+	for reponame, repo := range repos {
+		files, size, err := listCachedFiles(reponame, repo)
+		if err != nil {
+			gc_error_count.Inc()
+			log.Printf("gc: Error listing cache of %s for eviction: %v", reponame, err)
+			continue
+		}
+		if aboveHighWatermark(size, repo.cacheQuota) {
+			target := int64(float64(repo.cacheQuota) * *quotaLowWatermark)
+			log.Printf("gc: Cache of %s is %d bytes, over %v of quota %d bytes, evicting", reponame, size, *quotaHighWatermark, repo.cacheQuota)
+			var evicted []cachedFile
+			files, evicted = evictFiles(files, size-target, "repo over quota")
+			for _, file := range evicted {
+				size -= file.size
+			}
+		}
+		byRepo[reponame] = files
+		sizes[reponame] = size
+	}
+
+	var all []cachedFile
+	var globalSize int64
+	for _, files := range byRepo {
+		all = append(all, files...)
+	}
+	for _, size := range sizes {
+		globalSize += size
+	}
+	if aboveHighWatermark(globalSize, int64(*globalCacheQuota)) {
+		target := int64(float64(*globalCacheQuota) * *quotaLowWatermark)
+		log.Printf("gc: Cache of all repos is %d bytes, over %v of global quota %d bytes, evicting", globalSize, *quotaHighWatermark, int64(*globalCacheQuota))
+		var evicted []cachedFile
+		all, evicted = evictFiles(all, globalSize-target, "over global quota")
+		for _, file := range evicted {
+			sizes[file.reponame] -= file.size
+			globalSize -= file.size
+		}
+	}
+	if available, total := update_free_disk_space(); lowDiskSpace(available, total) {
+		target := int64(*minFreeDiskSpace) + int64(float64(total)*(*quotaHighWatermark-*quotaLowWatermark))
+		log.Printf("gc: Available disk space %d bytes, below %d bytes, evicting", available, int64(*minFreeDiskSpace))
+		_, evicted := evictFiles(all, target-available, "low disk space")
+		for _, file := range evicted {
+			sizes[file.reponame] -= file.size
+			globalSize -= file.size
+		}
+		update_free_disk_space()
+	}
+
+	for reponame, size := range sizes {
+		repos[reponame].cacheBytes.Store(size)
+		cache_size_bytes.WithLabelValues(reponame).Set(float64(size))
+	}
+	totalCacheBytes.Store(globalSize)
+	disk_cache_size_bytes.Set(float64(globalSize))
+	log.Printf("gc: Eviction check finished in %s, %d bytes in the cache", time.Since(t1), globalSize)
+}
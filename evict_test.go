@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuotaWatermarks(t *testing.T) {
+	defer func(high float64, minFree Size) {
+		*quotaHighWatermark, *minFreeDiskSpace = high, minFree
+	}(*quotaHighWatermark, *minFreeDiskSpace)
+	*quotaHighWatermark = 0.9
+	*minFreeDiskSpace = 100
+
+	highTests := []struct {
+		size, quota int64
+		want        bool
+	}{
+		{size: 900, quota: 1000, want: false},
+		{size: 901, quota: 1000, want: true},
+		{size: 5000, quota: 1000, want: true},
+		{size: 5000, quota: 0, want: false},
+	}
+	for _, test := range highTests {
+		if got := aboveHighWatermark(test.size, test.quota); got != test.want {
+			t.Errorf("aboveHighWatermark(%d, %d) = %v, want %v", test.size, test.quota, got, test.want)
+		}
+	}
+
+	lowTests := []struct {
+		available, total int64
+		want             bool
+	}{
+		{available: 99, total: 1000, want: true},
+		{available: 100, total: 1000, want: false},
+		// Unknown disk size.
+		{available: 0, total: 0, want: false},
+	}
+	for _, test := range lowTests {
+		if got := lowDiskSpace(test.available, test.total); got != test.want {
+			t.Errorf("lowDiskSpace(%d, %d) = %v, want %v", test.available, test.total, got, test.want)
+		}
+	}
+	*minFreeDiskSpace = 0
+	if lowDiskSpace(0, 1000) {
+		t.Errorf("lowDiskSpace() = true with --min_free_disk_space=0")
+	}
+}
+
+func TestEvictFiles(t *testing.T) {
+	chdirTestCache(t)
+	now := time.Now()
+	var files []cachedFile
+	for i, name := range []string{"new", "old", "oldest", "middle"} {
+		if err := os.WriteFile("cache/r/final/"+name, make([]byte, 10), 0640); err != nil {
+			t.Fatal(err)
+		}
+		age := map[string]time.Duration{"new": 0, "middle": 2, "old": 3, "oldest": 4}[name]
+		files = append(files, cachedFile{
+			reponame: "r",
+			filename: name,
+			size:     int64(10 + i),
+			lastUse:  now.Add(-age * time.Hour),
+		})
+	}
+
+	// Least recently used files, until enough is freed.
+	remaining, evicted := evictFiles(files, 20, "test")
+	var names []string
+	for _, file := range evicted {
+		names = append(names, file.filename)
+	}
+	if want := []string{"oldest", "old"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Evicted %q, want %q", names, want)
+	}
+	names = nil
+	for _, file := range remaining {
+		names = append(names, file.filename)
+	}
+	if want := []string{"middle", "new"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Remaining %q, want %q", names, want)
+	}
+	for name, cached := range map[string]bool{"new": true, "middle": true, "old": false, "oldest": false} {
+		if _, err := os.Stat("cache/r/final/" + name); (err == nil) != cached {
+			t.Errorf("File %q in cache = %v, want %v", name, err == nil, cached)
+		}
+	}
+
+	// Already removed files are not counted as freed.
+	os.Remove("cache/r/final/middle")
+	remaining, evicted = evictFiles(remaining, 1, "test")
+	if len(evicted) != 1 || evicted[0].filename != "new" || len(remaining) != 0 {
+		t.Errorf("Evicted %v, remaining %v, want only \"new\" evicted", evicted, remaining)
+	}
+}
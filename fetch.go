@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetch is a single upstream download of a file into the cache.
+//
+// Concurrent cache misses (and prefetcher) for the same file share one fetch.
+// Data is written to a temporary file, and all interested clients read it back
+// from there (using their own offsets) as soon as it arrives, so one upstream
+// download can serve any number of clients ("request and response gating").
+//
+// The download is not tied to any client request. If all clients disconnect,
+// the fetch still continues and populates the cache.
+type fetch struct {
+	reponame      string
+	filename      string
+	cacheFilename string
+	// Key in Repo.fetches, see fetchKey.
+	key string
+	// Client request headers to send to upstream.
+	forward http.Header
+
+	mu sync.Mutex
+	// Closed and replaced on every state change (new data, headers, done).
+	notify chan struct{}
+
+	// Set when checking if cached file changed upstream. Metadata of the
+	// cached file can be nil.
+	revalidate bool
+	cached     *CacheMeta
+
+	headersReady  bool
+	statusCode    int
+	contentLength int64 // -1 if unknown
+	meta          *CacheMeta
+	// Location of a redirect relayed to clients, see RedirectPolicy.Relay.
+	location string
+	// Forwarded request headers in the upstream Vary header, see vary.go.
+	varyNames []string
+	varyStar  bool
+
+	// Read-only handle to the temporary file. Shared by all readers, via
+	// ReadAt, which does not modify file offset, so is safe to use concurrently.
+	reader  *os.File
+	refs    int
+	written int64
+	done    bool
+	err     error
+}
+
+var errFetchIncomplete = errors.New("Upstream response body shorter than Content-Length")
+
+// startFetch returns in-progress fetch for a filename, or starts a new one.
+// Caller must call release() on the returned fetch when done reading from it.
+//
+// Returns nil fetch and nil error if the file was put in the cache in the
+// meantime, and can be served as a cache hit instead.
+//
+// If revalidate is true, file is already in the cache (with metadata
+// cached, if any), and the fetch makes a conditional request. If upstream
+// responds with 304, the fetch only updates the metadata, and statusCode of
+// the fetch is 304. Otherwise the new version of the file replaces the
+// cached one.
+//
+// forward are client request headers to send to upstream (see
+// forwardHeaders), nil for prefetch. Requests selecting different variants
+// of the file share a fetch only until variants are known, see fetchServes.
+//
+// started is true if caller started a new fetch, false if it joined existing one.
+func (repo *Repo) startFetch(reponame, filename, cacheFilename string, revalidate bool, cached *CacheMeta, forward http.Header) (f *fetch, started bool, err error) {
+	repo.fetchesMu.Lock()
+	defer repo.fetchesMu.Unlock()
+
+	key := fetchKey(reponame, filename, forward)
+	if f, ok := repo.fetches[key]; ok {
+		f.mu.Lock()
+		f.refs++
+		f.mu.Unlock()
+		return f, false, nil
+	}
+
+	upstreamURL := repo.upstreamURL(filename)
+	var cacheTemp *TempFile
+	var partial *partialProgress
+	if !revalidate {
+		// Fetch is removed from the map only after it was moved to the final
+		// location, so check again under lock, to not download it twice.
+		// Also the variant, if the file has variants (see vary.go).
+		if cache, _, err := openCached(reponame, filename, forward); err == nil {
+			cache.Close()
+			return nil, false, nil
+		}
+
+		cacheTemp, partial, err = loadPartial(reponame, filename, cacheFilename, upstreamURL)
+		if err != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Discarding partial download. Error: %v", reponame, filename, err)
+		}
+	}
+	if cacheTemp == nil {
+		cacheTemp, err = NewTempFile("cache/"+reponame+"/temp", filename, cacheFilename)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	reader, err := os.Open(cacheTemp.File().Name())
+	if err != nil {
+		cacheTemp.Cleanup()
+		return nil, false, err
+	}
+
+	f = &fetch{
+		reponame:      reponame,
+		filename:      filename,
+		cacheFilename: cacheFilename,
+		key:           key,
+		forward:       forward,
+		revalidate:    revalidate,
+		cached:        cached,
+		notify:        make(chan struct{}),
+		contentLength: -1,
+		reader:        reader,
+		refs:          2, // One for the caller, one for the download goroutine.
+	}
+	repo.fetches[key] = f
+	fetches_in_progress.Inc()
+
+	go f.run(repo, upstreamURL, cacheTemp, partial)
+
+	return f, true, nil
+}
+
+// cachedName returns filename of the cached file (relative to final/), which
+// might be a variant when revalidating.
+func (f *fetch) cachedName() string {
+	return strings.TrimPrefix(f.cacheFilename, "cache/"+f.reponame+"/final/")
+}
+
+// Must be called with f.mu held.
+func (f *fetch) broadcast() {
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *fetch) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.refs == 0 {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+func (f *fetch) finish(repo *Repo, err error) {
+	// Remove from the map first, so new requests are either cache hits
+	// or start a new fetch.
+	repo.fetchesMu.Lock()
+	delete(repo.fetches, f.key)
+	repo.fetchesMu.Unlock()
+	fetches_in_progress.Dec()
+
+	f.mu.Lock()
+	f.headersReady = true
+	f.done = true
+	f.err = err
+	f.broadcast()
+	f.mu.Unlock()
+
+	f.release()
+}
+
+// request makes upstream request. If resumeFrom is not zero, the request
+// asks only for the remaining part of the file, if it did not change.
+// If revalidating, the request is conditional.
+func (f *fetch) request(repo *Repo, resumeFrom int64, partial *partialProgress) (*http.Response, error) {
+	return repo.doUpstream(http.MethodGet, f.filename, func(req *http.Request) {
+		setForwardHeaders(req, f.forward)
+		if f.revalidate && f.cached != nil {
+			if f.cached.ETag != "" {
+				req.Header.Set("If-None-Match", f.cached.ETag)
+			}
+			if f.cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", f.cached.LastModified)
+			}
+		}
+		if resumeFrom > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(resumeFrom, 10)+"-")
+			if partial.ETag != "" {
+				req.Header.Set("If-Range", partial.ETag)
+			} else {
+				req.Header.Set("If-Range", partial.LastModified)
+			}
+		}
+	})
+}
+
+// run downloads the file, optionally resuming previous partial download.
+func (f *fetch) run(repo *Repo, upstreamURL string, cacheTemp *TempFile, partial *partialProgress) {
+	var err error
+	written := int64(0)
+	// Set when the partial download can be resumed later.
+	var progress *partialProgress
+	if partial != nil {
+		// Keep it, if the resume attempt fails before getting any new data.
+		progress = partial
+		written = partial.Written
+	}
+	defer func() {
+		saved := false
+		if err != nil && progress != nil && written > 0 {
+			progress.Written = written
+			if errSave := savePartial(cacheTemp, f.reponame, progress); errSave != nil {
+				error_count.Inc()
+				log.Printf("fetch: %s/%s Failed to save partial download for resume. Error: %v", f.reponame, f.filename, errSave)
+			} else {
+				saved = true
+				partial_saved_count.Inc()
+				log.Printf("fetch: %s/%s Saved partial download (%d / %d bytes) for resume", f.reponame, f.filename, written, progress.Size)
+			}
+		}
+		// No-op if already moved to final location, or saved for resume.
+		errCleanup := cacheTemp.Cleanup()
+		if errCleanup != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Temporary file cleanup failed. Error: %v", f.reponame, f.filename, errCleanup)
+		}
+		if !saved {
+			removePartialProgress(f.reponame, f.filename)
+		}
+		available, total := update_free_disk_space()
+		if lowDiskSpace(available, total) {
+			requestEviction()
+		}
+		f.finish(repo, err)
+	}()
+
+	t1 := time.Now()
+	resumeFrom := int64(0)
+	if partial != nil {
+		resumeFrom = partial.Written
+	}
+	resp, err := f.request(repo, resumeFrom, partial)
+	if err != nil {
+		upstream_error_count.Inc()
+		log.Printf("fetch: %s/%s Upstream request error: %v", f.reponame, f.filename, err)
+		return
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+
+	contentLength := resp.ContentLength
+	if resumeFrom > 0 {
+		start, total, ok := parseContentRange(resp)
+		if resp.StatusCode == http.StatusPartialContent && ok && start == resumeFrom && total == partial.Size {
+			contentLength = total
+			fetch_resume_count.Inc()
+			log.Printf("fetch: %s/%s Resuming partial download from %d / %d bytes", f.reponame, f.filename, resumeFrom, total)
+		} else if resp.StatusCode >= 500 {
+			// Keep partial data for the next try. Handled below.
+		} else {
+			log.Printf("fetch: %s/%s Cannot resume partial download (status %d), downloading from the start", f.reponame, f.filename, resp.StatusCode)
+			progress = nil
+			written = 0
+			if err = cacheTemp.Truncate(); err != nil {
+				error_count.Inc()
+				log.Printf("fetch: %s/%s Failed to truncate partial download. Error: %v", f.reponame, f.filename, err)
+				return
+			}
+			if resp.StatusCode != 200 {
+				// Not a full response either (i.e. 416), so ask again without range.
+				resp.Body.Close()
+				resp, err = f.request(repo, 0, nil)
+				if err != nil {
+					upstream_error_count.Inc()
+					log.Printf("fetch: %s/%s Upstream request error: %v", f.reponame, f.filename, err)
+					return
+				}
+				contentLength = resp.ContentLength
+			}
+		}
+	}
+
+	statusCode := resp.StatusCode
+	if statusCode == http.StatusPartialContent && written > 0 {
+		// For readers it is like a full response.
+		statusCode = http.StatusOK
+	}
+	// URL of the mirror the file was actually downloaded from.
+	meta := newCacheMeta(redactURL(resp.Request.URL), resp)
+	meta.Headers = repo.responseHeaders(resp.Header)
+	meta.Redirects = redirectChain(resp)
+	if len(meta.Redirects) > 0 {
+		log.Printf("fetch: %s/%s Redirected %s -> %s", f.reponame, f.filename, strings.Join(meta.Redirects, " -> "), meta.URL)
+	}
+	var location, redactedLocation string
+	if isRedirect(statusCode) {
+		if u, err := resp.Location(); err == nil {
+			location, redactedLocation = u.String(), redactURL(u)
+		}
+	}
+	if written > 0 {
+		// Validators are of the original response.
+		meta.ETag, meta.LastModified = partial.ETag, partial.LastModified
+	}
+	varyNames, varyStar := repo.varyNames(resp.Header)
+
+	f.mu.Lock()
+	f.statusCode = statusCode
+	f.contentLength = contentLength
+	f.meta = meta
+	f.location = location
+	f.varyNames = varyNames
+	f.varyStar = varyStar
+	f.written = written
+	f.headersReady = true
+	f.broadcast()
+	f.mu.Unlock()
+
+	if statusCode == http.StatusNotModified && f.revalidate {
+		repo.dirMu.RLock()
+		err = touchCacheMeta(f.reponame, f.cachedName(), f.cacheFilename, f.cached, resp.Header)
+		repo.dirMu.RUnlock()
+		if err != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Failed to update metadata of revalidated file. Error: %v", f.reponame, f.filename, err)
+			// Still fine to serve it.
+			err = nil
+		}
+		log.Printf("fetch: %s/%s Not modified upstream in %v", f.reponame, f.filename, time.Since(t1))
+		return
+	}
+	if location != "" {
+		redirect_relayed_count.Inc()
+		log.Printf("fetch: %s/%s Relaying redirect (status %d) to %s", f.reponame, f.filename, statusCode, redactedLocation)
+		return
+	}
+	if statusCode != 200 {
+		upstream_error_count.Inc()
+		if !f.revalidate {
+			// Revalidation failures are served stale instead.
+			repo.storeNegative(f.reponame, f.filename, statusCode)
+		}
+		if statusCode >= 500 {
+			// Possibly temporary upstream issue. Keep partial data if any.
+			err = fmt.Errorf("Upstream responded with status %d", statusCode)
+		}
+		// Otherwise not really an error of the fetch itself. Readers will
+		// relay the status.
+		return
+	}
+
+	cacheable := isCacheable(meta) && !varyStar
+	if !cacheable {
+		uncacheable_count.Inc()
+		log.Printf("fetch: %s/%s Upstream does not allow caching (Cache-Control: %s, Vary: %s), only streaming to clients", f.reponame, f.filename, meta.CacheControl, resp.Header.Get("Vary"))
+	}
+	policy := repo.cachePolicy(f.filename)
+	if cacheable && !policy.allowsCaching(contentLength) {
+		cacheable = false
+		uncacheable_count.Inc()
+		log.Printf("fetch: %s/%s Cache policy %q does not allow caching (size %d), only streaming to clients", f.reponame, f.filename, policy.re, contentLength)
+	}
+
+	// Download can be resumed only if we can check that the file did not
+	// change in the meantime, and we know when it is complete.
+	if cacheable && contentLength > 0 && (meta.ETag != "" || meta.LastModified != "") {
+		progress = &partialProgress{
+			Filename:     f.filename,
+			URL:          upstreamURL,
+			Size:         contentLength,
+			ETag:         meta.ETag,
+			LastModified: meta.LastModified,
+			Written:      written,
+		}
+	}
+
+	sums := newChecksums()
+	if written > 0 {
+		// Include already downloaded part.
+		if _, err = io.Copy(sums, io.NewSectionReader(cacheTemp.File(), 0, written)); err != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Failed to read partial download. Error: %v", f.reponame, f.filename, err)
+			progress = nil
+			return
+		}
+	}
+
+	buf := make([]byte, BUFFERSIZE)
+	for {
+		n, errRead := resp.Body.Read(buf)
+		if n > 0 {
+			if n2, errWrite := cacheTemp.File().Write(buf[:n]); errWrite != nil || n2 != n {
+				error_count.Inc()
+				log.Printf("fetch: %s/%s Write error to cache file after %d bytes. Attempted to write %d bytes, wrote %d bytes. Error: %v", f.reponame, f.filename, written, n, n2, errWrite)
+				if errWrite == nil {
+					errWrite = io.ErrShortWrite
+				}
+				err = errWrite
+				// Do not bother trying to keep data on disk errors.
+				progress = nil
+				return
+			}
+			sums.Write(buf[:n])
+			written += int64(n)
+			upstream_fetch_bytes.Add(float64(n))
+
+			f.mu.Lock()
+			f.written = written
+			f.broadcast()
+			f.mu.Unlock()
+		}
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			upstream_error_count.Inc()
+			log.Printf("fetch: %s/%s Upstream read error after %d bytes. Error: %v", f.reponame, f.filename, written, errRead)
+			err = errRead
+			return
+		}
+	}
+	if contentLength >= 0 && written != contentLength {
+		upstream_error_count.Inc()
+		log.Printf("fetch: %s/%s Upstream response truncated. Got %d bytes, expected %d bytes", f.reponame, f.filename, written, f.contentLength)
+		err = errFetchIncomplete
+		return
+	}
+
+	if cacheable && !policy.allowsCaching(written) {
+		cacheable = false
+		uncacheable_count.Inc()
+		log.Printf("fetch: %s/%s Cache policy %q does not allow caching (size %d)", f.reponame, f.filename, policy.re, written)
+	}
+	if !cacheable {
+		if f.revalidate {
+			// Previously cacheable, but not anymore.
+			os.Remove(f.cacheFilename)
+			removeCacheMeta(f.reponame, f.cachedName())
+		}
+		log.Printf("fetch: %s/%s Finished streaming %d bytes in %v, discarding", f.reponame, f.filename, written, time.Since(t1))
+		return
+	}
+
+	// Directories created below must not be removed as empty, until the
+	// file is in them.
+	repo.dirMu.RLock()
+	defer repo.dirMu.RUnlock()
+	// Filename relative to final/, different for variants, see vary.go.
+	finalName := f.filename
+	if len(varyNames) > 0 {
+		finalName = variantFilename(f.filename, varyKey(varyNames, f.forward))
+		if err = storeVaryNames(f.reponame, f.filename, varyNames); err != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Failed storing Vary header names. Error: %v", f.reponame, f.filename, err)
+			return
+		}
+	}
+	// When revalidating a variant, cacheFilename is the variant.
+	cacheTemp.SetFinalPath("cache/" + f.reponame + "/final/" + finalName)
+	lastSlash := strings.LastIndex(finalName, "/")
+	if lastSlash != -1 {
+		err = os.MkdirAll("cache/"+f.reponame+"/final/"+finalName[0:lastSlash], 0750)
+		if err != nil {
+			error_count.Inc()
+			log.Printf("fetch: %s/%s Failed creating final subdirectory for cache file. Error: %v", f.reponame, f.filename, err)
+			return
+		}
+	}
+	meta.FetchTime = time.Now()
+	meta.Size = written
+	meta.Checksums = sums.Sums()
+	if errMeta := writeCacheMeta(cacheTemp.File(), f.reponame, finalName, meta); errMeta != nil {
+		// Not fatal. File will be served with default headers.
+		error_count.Inc()
+		log.Printf("fetch: %s/%s Failed to store cache file metadata. Error: %v", f.reponame, f.filename, errMeta)
+	}
+	err = cacheTemp.Finalize()
+	if err != nil {
+		error_count.Inc()
+		log.Printf("fetch: %s/%s Failed closing or moving temporary cache file. Error: %v", f.reponame, f.filename, err)
+		return
+	}
+	if finalName != f.filename {
+		// Upstream started to use Vary. Remove the single version.
+		if os.Remove("cache/"+f.reponame+"/final/"+f.filename) == nil {
+			removeCacheMeta(f.reponame, f.filename)
+		}
+	} else {
+		// Upstream stopped using Vary. Remove old variants.
+		os.RemoveAll(varyDir(f.reponame, f.filename))
+	}
+	removeNegative(f.reponame, f.filename)
+	repo.cacheAdded(written)
+	log.Printf("fetch: %s/%s Finished fetching %d bytes in %v", f.reponame, f.filename, written, time.Since(t1))
+}
+
+// waitHeaders waits until upstream response status is known.
+func (f *fetch) waitHeaders(ctx context.Context) error {
+	f.mu.Lock()
+	for !f.headersReady {
+		ch := f.notify
+		f.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// waitData waits until there is more than offset bytes available in the
+// temporary file, or the fetch is finished. Returns number of bytes available,
+// and if no more data will be coming, the final fetch error.
+func (f *fetch) waitData(ctx context.Context, offset int64) (available int64, done bool, err error) {
+	f.mu.Lock()
+	for f.written <= offset && !f.done {
+		ch := f.notify
+		f.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return offset, false, ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	return f.written, f.done, f.err
+}
+
+// wait waits for the fetch to finish and returns its final error.
+func (f *fetch) wait() error {
+	_, _, err := f.waitData(context.Background(), 1<<62)
+	return err
+}
+
+// copyTo copies bytes [offset, end) of the file to w, as they become
+// available. end can be -1 to copy until end of the file.
+func (f *fetch) copyTo(ctx context.Context, w io.Writer, offset, end int64) (int64, error) {
+	copied := int64(0)
+	for end < 0 || offset < end {
+		available, done, err := f.waitData(ctx, offset)
+		if available > offset {
+			if end >= 0 && available > end {
+				available = end
+			}
+			n, errCopy := io.Copy(w, io.NewSectionReader(f.reader, offset, available-offset))
+			copied += n
+			offset += n
+			if errCopy != nil {
+				return copied, errCopy
+			}
+			continue
+		}
+		if err != nil {
+			return copied, err
+		}
+		if done {
+			break
+		}
+	}
+	return copied, nil
+}
+
+// fetchReader is io.ReadSeeker over the file being fetched, to be used with
+// http.ServeContent. Reads block until requested data arrives from upstream.
+// Can only be used when the size of the file is known in advance.
+type fetchReader struct {
+	ctx    context.Context
+	f      *fetch
+	offset int64
+	// First error encountered while waiting for the data.
+	err error
+}
+
+func (fr *fetchReader) Read(p []byte) (int, error) {
+	if fr.offset >= fr.f.contentLength {
+		return 0, io.EOF
+	}
+	available, done, err := fr.f.waitData(fr.ctx, fr.offset)
+	if available > fr.offset {
+		if int64(len(p)) > available-fr.offset {
+			p = p[:available-fr.offset]
+		}
+		n, err := fr.f.reader.ReadAt(p, fr.offset)
+		fr.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			// End of data written so far, not end of the file.
+			err = nil
+		}
+		if err != nil && fr.err == nil {
+			fr.err = err
+		}
+		return n, err
+	}
+	if err == nil && done {
+		err = errFetchIncomplete
+	}
+	if fr.err == nil {
+		fr.err = err
+	}
+	return 0, err
+}
+
+func (fr *fetchReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.offset
+	case io.SeekEnd:
+		offset += fr.f.contentLength
+	default:
+		return 0, errors.New("fetchReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("fetchReader.Seek: negative position")
+	}
+	fr.offset = offset
+	return offset, nil
+}
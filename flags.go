@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -14,8 +16,17 @@ import (
 )
 
 var (
-	listenPort = flag.Int("listen_port", 8080, "A TCP port number on which to start HTTP server to perform proxying for clients and /metrics endpoint for Prometheus monitoring")
-	repoRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\.\-]+$`)
+	listenPort          = flag.Int("listen_port", 8080, "A TCP port number on which to start HTTP server to perform proxying for clients and /metrics endpoint for Prometheus monitoring")
+	resolveInterval     = flag.Duration("upstream_resolve_interval", time.Minute, "How often to check that hostnames of upstream URLs (mirrors) can be resolved. Unresolvable ones are marked unhealthy, and reported on /ready endpoint")
+	healthCheckInterval = flag.Duration("upstream_health_check_interval", 30*time.Second, "How often to actively check health of upstream URLs (mirrors). 0 disables active checks")
+	accessIndexInterval = flag.Duration("access_index_save_interval", time.Minute, "How often to save index of when cached files were last served (used by GC and eviction instead of file access times) to disk. 0 to save only after GC and eviction")
+	cleanupInterval     = flag.Duration("cleanup_interval", time.Hour, "How often to remove stale temporary files (--temp_max_age) and empty directories from the cache. Also done on startup. 0 to do it only on startup")
+	tempMaxAge          = flag.Duration("temp_max_age", 24*time.Hour, "Remove temporary files (including partial downloads kept for resuming) not modified for this long")
+	globalCacheQuota    = sizeFlag("global_cache_quota", 0, "Maximum size of files in the cache of all repos together, i.e. 500G. When exceeded, least recently used files are evicted. 0 for no limit")
+	minFreeDiskSpace    = sizeFlag("min_free_disk_space", 0, "When available disk space drops below this, i.e. 10G, least recently used files of all repos are evicted, until it is above it by the difference of watermarks (as fraction of the disk size). 0 disables")
+	quotaHighWatermark  = flag.Float64("quota_high_watermark", 0.95, "Eviction starts when cache size exceeds this fraction of the quota (--cache_quota, --global_cache_quota)")
+	quotaLowWatermark   = flag.Float64("quota_low_watermark", 0.85, "Eviction removes files until cache size is below this fraction of the quota")
+	repoRegexp          = regexp.MustCompile(`^[a-zA-Z0-9_\.\-]+$`)
 )
 
 func splitFlag(value string) (string, string, error) {
@@ -39,7 +50,8 @@ func splitFlag(value string) (string, string, error) {
 	return reponame, v, nil
 }
 
-type UpstreamURLs map[string]string
+// Ordered list of upstream URLs (mirrors) for each repo.
+type UpstreamURLs map[string][]string
 
 func (i *UpstreamURLs) String() string {
 	return fmt.Sprintf("%#v", *i)
@@ -50,9 +62,10 @@ func (i *UpstreamURLs) Set(value string) error {
 	if err != nil {
 		return err
 	}
-	_, exists := (*i)[reponame]
-	if exists {
-		return errors.New("Flag value invalid. Upstream URL for a repo with same name already defined")
+	for _, existing := range (*i)[reponame] {
+		if existing == repourl {
+			return errors.New("Flag value invalid. Same upstream URL for a repo already defined")
+		}
 	}
 	u, err := url.Parse(repourl)
 	if err != nil {
@@ -67,13 +80,10 @@ func (i *UpstreamURLs) Set(value string) error {
 	if len(u.Fragment) != 0 {
 		return errors.New("Fragment part (after # in URL) is not allowed")
 	}
-	hostname := u.Hostname()
-	addrs, err := net.LookupHost(hostname)
-	if err != nil {
-		return errors.New("Could not resolve hostname specified in repo URL definition")
-	}
-	if len(addrs) == 0 {
-		return errors.New("Resolving hostname specified in repo URL definition gave 0 addresses")
+	// Hostname is not resolved here, DNS might not be available yet.
+	// See resolveUpstreams.
+	if len(u.Hostname()) == 0 {
+		return errors.New("Missing hostname in repo URL definition")
 	}
 	portStr := u.Port()
 	if portStr != "" {
@@ -86,7 +96,7 @@ func (i *UpstreamURLs) Set(value string) error {
 		}
 	}
 	log.Printf("Repo: %q -> %#v", reponame, u)
-	(*i)[reponame] = repourl
+	(*i)[reponame] = append((*i)[reponame], repourl)
 	return nil
 }
 
@@ -135,13 +145,10 @@ func (i *PrefetchSpecs) Set(value string) error {
 	if len(u.Fragment) != 0 {
 		return errors.New("Fragment part (after # in URL) is not allowed")
 	}
-	hostname := u.Hostname()
-	addrs, err := net.LookupHost(hostname)
-	if err != nil {
-		return errors.New("Could not resolve hostname specified in nexus URL definition")
-	}
-	if len(addrs) == 0 {
-		return errors.New("Resolving hostname specified in nexus URL definition gave 0 addresses")
+	// Hostname is not resolved here, DNS might not be available yet. It is
+	// resolved by each prefetch listing, which is retried by the next one.
+	if len(u.Hostname()) == 0 {
+		return errors.New("Missing hostname in nexus URL definition")
 	}
 	portStr := u.Port()
 	if portStr != "" {
@@ -203,3 +210,612 @@ func (i *GCMaxAges) Set(value string) error {
 	(*i)[reponame] = maxAgeDuration
 	return nil
 }
+
+type MutableRule struct {
+	Regexp string
+	MaxAge time.Duration
+}
+type MutableRules map[string][]MutableRule
+
+func (i *MutableRules) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *MutableRules) Set(value string) error {
+	reponame, rule, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	// Regular expression itself can contain =, so split on the last one.
+	lastEqual := strings.LastIndex(rule, "=")
+	if lastEqual == -1 {
+		return errors.New("Flag value invalid. Must be in form of reponame=regexp=duration")
+	}
+	re, maxAge := rule[:lastEqual], rule[lastEqual+1:]
+	if len(re) == 0 {
+		return errors.New("Flag value invalid. Empty regular expression")
+	}
+	if _, err := regexp.Compile(re); err != nil {
+		return errors.New("Flag value invalid. Invalid regular expression")
+	}
+	maxAgeDuration, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return errors.New("Flag value invalid. Invalid duration format")
+	}
+	(*i)[reponame] = append((*i)[reponame], MutableRule{
+		Regexp: re,
+		MaxAge: maxAgeDuration,
+	})
+	return nil
+}
+
+type CachePolicy struct {
+	Regexp  string
+	MaxAge  time.Duration
+	MinAge  time.Duration
+	NoCache bool
+	Pin     bool
+	MinSize int64
+	MaxSize int64
+}
+type CachePolicies map[string][]CachePolicy
+
+func (i *CachePolicies) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *CachePolicies) Set(value string) error {
+	reponame, rule, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	// Regular expression can contain anything, so it is last. Options
+	// cannot contain :.
+	options, re, good := strings.Cut(rule, ":")
+	if !good {
+		return errors.New("Flag value invalid. Must be in form of reponame=options:regexp")
+	}
+	if len(re) == 0 {
+		return errors.New("Flag value invalid. Empty regular expression")
+	}
+	if _, err := regexp.Compile(re); err != nil {
+		return errors.New("Flag value invalid. Invalid regular expression")
+	}
+	policy := CachePolicy{Regexp: re}
+	for _, part := range strings.Split(options, ",") {
+		key, optionValue, good := strings.Cut(part, "=")
+		if !good || len(optionValue) == 0 {
+			return fmt.Errorf("Flag value invalid. Option %q must be in form of key=value", part)
+		}
+		switch key {
+		case "max_age", "min_age":
+			duration, err := time.ParseDuration(optionValue)
+			if err != nil {
+				return errors.New("Flag value invalid. Invalid duration format")
+			}
+			if key == "max_age" {
+				policy.MaxAge = duration
+			} else {
+				policy.MinAge = duration
+			}
+		case "cache", "pin":
+			b, err := strconv.ParseBool(optionValue)
+			if err != nil {
+				return err
+			}
+			if key == "cache" {
+				policy.NoCache = !b
+			} else {
+				policy.Pin = b
+			}
+		case "min_size", "max_size":
+			size, err := parseSize(optionValue)
+			if err != nil {
+				return err
+			}
+			if key == "min_size" {
+				policy.MinSize = size
+			} else {
+				policy.MaxSize = size
+			}
+		default:
+			return fmt.Errorf("Flag value invalid. Unknown option %q", key)
+		}
+	}
+	(*i)[reponame] = append((*i)[reponame], policy)
+	return nil
+}
+
+type RepoBools map[string]bool
+
+func (i *RepoBools) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *RepoBools) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return errors.New("Flag value invalid. Must be true or false")
+	}
+	(*i)[reponame] = b
+	return nil
+}
+
+type RepoDurations map[string]time.Duration
+
+func (i *RepoDurations) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *RepoDurations) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	duration, err := time.ParseDuration(v)
+	if err != nil {
+		return errors.New("Flag value invalid. Invalid duration format")
+	}
+	(*i)[reponame] = duration
+	return nil
+}
+
+// parseSize parses size in bytes, with optional K, M, G or T suffix (powers
+// of 1024).
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	if len(value) > 0 {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("Flag value invalid. Invalid size format")
+	}
+	return n * multiplier, nil
+}
+
+type Size int64
+
+func (i *Size) String() string {
+	return strconv.FormatInt(int64(*i), 10)
+}
+func (i *Size) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*i = Size(n)
+	return nil
+}
+
+func sizeFlag(name string, value int64, usage string) *Size {
+	size := Size(value)
+	flag.Var(&size, name, usage)
+	return &size
+}
+
+type RepoSizes map[string]int64
+
+func (i *RepoSizes) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *RepoSizes) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	size, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	(*i)[reponame] = size
+	return nil
+}
+
+type RepoStrings map[string]string
+
+func (i *RepoStrings) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *RepoStrings) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	if len(v) == 0 {
+		return errors.New("Flag value invalid. Empty value")
+	}
+	(*i)[reponame] = v
+	return nil
+}
+
+type UpstreamTLSOption struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	MinVersion uint16
+	ServerName string
+	// Base64 encoded SHA-256 hashes of SubjectPublicKeyInfo.
+	Pins []string
+}
+
+type UpstreamTLSOptions map[string]UpstreamTLSOption
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (i *UpstreamTLSOptions) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *UpstreamTLSOptions) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	var option UpstreamTLSOption
+	for _, part := range strings.Split(v, ",") {
+		key, optionValue, good := strings.Cut(part, "=")
+		if !good || len(optionValue) == 0 {
+			return fmt.Errorf("Flag value invalid. Option %q must be in form of key=value", part)
+		}
+		switch key {
+		case "ca":
+			option.CAFile = optionValue
+		case "cert":
+			option.CertFile = optionValue
+		case "key":
+			option.KeyFile = optionValue
+		case "min_version":
+			version, known := tlsVersions[optionValue]
+			if !known {
+				return fmt.Errorf("Flag value invalid. Unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", optionValue)
+			}
+			option.MinVersion = version
+		case "server_name":
+			option.ServerName = optionValue
+		case "pin":
+			pin, good := strings.CutPrefix(optionValue, "sha256//")
+			if !good {
+				return errors.New("Flag value invalid. Pin must be in form of sha256//BASE64")
+			}
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return errors.New("Flag value invalid. Pin is not a base64 encoded SHA-256 hash")
+			}
+			option.Pins = append(option.Pins, pin)
+		default:
+			return fmt.Errorf("Flag value invalid. Unknown option %q", key)
+		}
+	}
+	if (option.CertFile == "") != (option.KeyFile == "") {
+		return errors.New("Flag value invalid. Both cert and key must be specified")
+	}
+	(*i)[reponame] = option
+	return nil
+}
+
+type UpstreamClientOption struct {
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleBodyTimeout       time.Duration
+	MaxConnsPerHost       int
+	Retries               int
+	RetryBackoff          time.Duration
+	MaxBackoff            time.Duration
+}
+
+type UpstreamClientOptions map[string]UpstreamClientOption
+
+func defaultUpstreamClientOption() UpstreamClientOption {
+	return UpstreamClientOption{
+		ConnectTimeout:        10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		IdleBodyTimeout:       60 * time.Second,
+		Retries:               2,
+		RetryBackoff:          500 * time.Millisecond,
+		MaxBackoff:            30 * time.Second,
+	}
+}
+
+// Retries are done while clients wait for the response, so more are not
+// useful.
+const maxUpstreamRetries = 10
+
+func (i *UpstreamClientOptions) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *UpstreamClientOptions) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	option := defaultUpstreamClientOption()
+	for _, part := range strings.Split(v, ",") {
+		key, optionValue, good := strings.Cut(part, "=")
+		if !good || len(optionValue) == 0 {
+			return fmt.Errorf("Flag value invalid. Option %q must be in form of key=value", part)
+		}
+		var duration *time.Duration
+		var number *int
+		switch key {
+		case "connect_timeout":
+			duration = &option.ConnectTimeout
+		case "tls_timeout":
+			duration = &option.TLSHandshakeTimeout
+		case "header_timeout":
+			duration = &option.ResponseHeaderTimeout
+		case "idle_timeout":
+			duration = &option.IdleBodyTimeout
+		case "retry_backoff":
+			duration = &option.RetryBackoff
+		case "max_backoff":
+			duration = &option.MaxBackoff
+		case "max_conns":
+			number = &option.MaxConnsPerHost
+		case "retries":
+			number = &option.Retries
+		default:
+			return fmt.Errorf("Flag value invalid. Unknown option %q", key)
+		}
+		if duration != nil {
+			d, err := time.ParseDuration(optionValue)
+			if err != nil {
+				return err
+			}
+			if d < 0 {
+				return fmt.Errorf("Flag value invalid. Option %q must not be negative", key)
+			}
+			*duration = d
+		} else {
+			n, err := strconv.Atoi(optionValue)
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("Flag value invalid. Option %q must not be negative", key)
+			}
+			if key == "retries" && n > maxUpstreamRetries {
+				return fmt.Errorf("Flag value invalid. Option %q must be at most %d", key, maxUpstreamRetries)
+			}
+			*number = n
+		}
+	}
+	if option.RetryBackoff > option.MaxBackoff {
+		return errors.New("Flag value invalid. Option \"retry_backoff\" must not exceed \"max_backoff\"")
+	}
+	(*i)[reponame] = option
+	return nil
+}
+
+type CircuitBreakerOption struct {
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	OpenFor     time.Duration
+}
+
+type CircuitBreakerOptions map[string]CircuitBreakerOption
+
+func (i *CircuitBreakerOptions) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *CircuitBreakerOptions) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	option := CircuitBreakerOption{
+		ErrorRate:   0.5,
+		MinRequests: 10,
+		Window:      time.Minute,
+		OpenFor:     30 * time.Second,
+	}
+	for _, part := range strings.Split(v, ",") {
+		key, optionValue, good := strings.Cut(part, "=")
+		if !good || len(optionValue) == 0 {
+			return fmt.Errorf("Flag value invalid. Option %q must be in form of key=value", part)
+		}
+		switch key {
+		case "error_rate":
+			rate, err := strconv.ParseFloat(optionValue, 64)
+			if err != nil {
+				return err
+			}
+			if !(0 < rate && rate <= 1) {
+				return errors.New("Flag value invalid. Option error_rate must be in (0, 1] range")
+			}
+			option.ErrorRate = rate
+		case "min_requests":
+			n, err := strconv.Atoi(optionValue)
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return errors.New("Flag value invalid. Option min_requests must be positive")
+			}
+			option.MinRequests = n
+		case "window", "open_for":
+			d, err := time.ParseDuration(optionValue)
+			if err != nil {
+				return err
+			}
+			if d <= 0 {
+				return fmt.Errorf("Flag value invalid. Option %q must be positive", key)
+			}
+			if key == "window" {
+				option.Window = d
+			} else {
+				option.OpenFor = d
+			}
+		default:
+			return fmt.Errorf("Flag value invalid. Unknown option %q", key)
+		}
+	}
+	(*i)[reponame] = option
+	return nil
+}
+
+type UpstreamProxies map[string]*url.URL
+
+func (i *UpstreamProxies) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *UpstreamProxies) Set(value string) error {
+	reponame, proxyurl, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	u, err := url.Parse(proxyurl)
+	if err != nil {
+		return errors.New("Failed parsing proxy url")
+	}
+	if !(u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "socks5" || u.Scheme == "socks5h") {
+		return errors.New("Only http, https, socks5 and socks5h proxy schemas are supported")
+	}
+	if len(u.Hostname()) == 0 {
+		return errors.New("Proxy url must contain a host")
+	}
+	if u.User != nil {
+		return errors.New("Proxy credentials must not be passed in url, use --upstream_proxy_auth")
+	}
+	(*i)[reponame] = u
+	return nil
+}
+
+type HeaderLists map[string][]string
+
+func (i *HeaderLists) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *HeaderLists) Set(value string) error {
+	reponame, list, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	names, invalid := canonicalHeaderNames(list)
+	if names == nil {
+		return fmt.Errorf("Flag value invalid. Header %q cannot be forwarded", invalid)
+	}
+	(*i)[reponame] = append((*i)[reponame], names...)
+	return nil
+}
+
+type RedirectPolicy struct {
+	MaxHops int
+	// Empty allows any host.
+	AllowHosts  []string
+	ForwardAuth bool
+	// Relay 3xx responses to clients, instead of following them.
+	Relay bool
+}
+
+type RedirectPolicies map[string]RedirectPolicy
+
+func defaultRedirectPolicy() RedirectPolicy {
+	return RedirectPolicy{
+		MaxHops: 10,
+	}
+}
+
+func (i *RedirectPolicies) String() string {
+	return fmt.Sprintf("%#v", *i)
+}
+func (i *RedirectPolicies) Set(value string) error {
+	reponame, v, err := splitFlag(value)
+	if err != nil {
+		return err
+	}
+	_, exists := (*i)[reponame]
+	if exists {
+		return errors.New("Flag value invalid. Value for a repo with same name already defined")
+	}
+	policy := defaultRedirectPolicy()
+	for _, part := range strings.Split(v, ",") {
+		key, optionValue, good := strings.Cut(part, "=")
+		if !good || len(optionValue) == 0 {
+			return fmt.Errorf("Flag value invalid. Option %q must be in form of key=value", part)
+		}
+		switch key {
+		case "max_hops":
+			n, err := strconv.Atoi(optionValue)
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return errors.New("Flag value invalid. Option max_hops must not be negative")
+			}
+			policy.MaxHops = n
+		case "allow_host":
+			policy.AllowHosts = append(policy.AllowHosts, strings.ToLower(optionValue))
+		case "forward_auth":
+			b, err := strconv.ParseBool(optionValue)
+			if err != nil {
+				return err
+			}
+			policy.ForwardAuth = b
+		case "mode":
+			switch optionValue {
+			case "follow":
+				policy.Relay = false
+			case "relay":
+				policy.Relay = true
+			default:
+				return errors.New("Flag value invalid. Option mode must be follow or relay")
+			}
+		default:
+			return fmt.Errorf("Flag value invalid. Unknown option %q", key)
+		}
+	}
+	(*i)[reponame] = policy
+	return nil
+}
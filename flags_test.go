@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMutableRulesSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   MutableRules
+		err    bool
+	}{
+		{
+			values: []string{`r=.*/maven-metadata\.xml$=5m`, "r=^index.yaml$=1h", "other=x=0s"},
+			want: MutableRules{
+				"r":     {{`.*/maven-metadata\.xml$`, 5 * time.Minute}, {"^index.yaml$", time.Hour}},
+				"other": {{"x", 0}},
+			},
+		},
+		// Regular expression containing =.
+		{values: []string{"r=^a=b$=10s"}, want: MutableRules{"r": {{"^a=b$", 10 * time.Second}}}},
+		{values: []string{"r=5m"}, err: true},
+		{values: []string{"r==5m"}, err: true},
+		{values: []string{"r=[=5m"}, err: true},
+		{values: []string{"r=x=5"}, err: true},
+		{values: []string{"r"}, err: true},
+	}
+	for _, test := range tests {
+		rules := MutableRules{}
+		var err error
+		for _, value := range test.values {
+			if err = rules.Set(value); err != nil {
+				break
+			}
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("Set(%q) = %#v, want error", test.values, rules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) error: %v", test.values, err)
+		} else if !reflect.DeepEqual(rules, test.want) {
+			t.Errorf("Set(%q) = %#v, want %#v", test.values, rules, test.want)
+		}
+	}
+}
+
+func TestUpstreamTLSOptionsSet(t *testing.T) {
+	pin := "sha256//47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	tests := []struct {
+		value string
+		want  UpstreamTLSOption
+		err   bool
+	}{
+		{
+			value: "r=ca=/etc/ca.pem,min_version=1.3,server_name=nexus.internal",
+			want:  UpstreamTLSOption{CAFile: "/etc/ca.pem", MinVersion: tls.VersionTLS13, ServerName: "nexus.internal"},
+		},
+		{
+			value: "r=cert=c.pem,key=k.pem," + "pin=" + pin + ",pin=" + pin,
+			want: UpstreamTLSOption{CertFile: "c.pem", KeyFile: "k.pem", Pins: []string{
+				"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+			}},
+		},
+		{value: "r=cert=c.pem", err: true},
+		{value: "r=key=k.pem", err: true},
+		{value: "r=min_version=1.4", err: true},
+		{value: "r=pin=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", err: true},
+		{value: "r=pin=sha256//AAAA", err: true},
+		{value: "r=ca=", err: true},
+		{value: "r=verify=false", err: true},
+	}
+	for _, test := range tests {
+		options := UpstreamTLSOptions{}
+		err := options.Set(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("Set(%q) = %#v, want error", test.value, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) error: %v", test.value, err)
+		} else if !reflect.DeepEqual(options["r"], test.want) {
+			t.Errorf("Set(%q) = %#v, want %#v", test.value, options["r"], test.want)
+		}
+	}
+	options := UpstreamTLSOptions{}
+	options.Set("r=min_version=1.2")
+	if err := options.Set("r=min_version=1.3"); err == nil {
+		t.Errorf("Set() for the same repo twice, want error")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{value: "0", want: 0},
+		{value: "1234", want: 1234},
+		{value: "1K", want: 1 << 10},
+		{value: "10M", want: 10 << 20},
+		{value: "500G", want: 500 << 30},
+		{value: "2T", want: 2 << 40},
+		{value: "", err: true},
+		{value: "G", err: true},
+		{value: "-1", err: true},
+		{value: "1.5G", err: true},
+		{value: "10k", err: true},
+		{value: "10GB", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSize(%q) error: %v", test.value, err)
+		} else if got != test.want {
+			t.Errorf("parseSize(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestQuotaFlagsSet(t *testing.T) {
+	var size Size
+	if err := size.Set("10G"); err != nil || size != 10<<30 || size.String() != "10737418240" {
+		t.Errorf("Size.Set(\"10G\") = %s, error %v", size.String(), err)
+	}
+	if err := size.Set("x"); err == nil {
+		t.Errorf("Size.Set(\"x\"), want error")
+	}
+
+	quotas := RepoSizes{}
+	for _, value := range []string{"r=100M", "other=0"} {
+		if err := quotas.Set(value); err != nil {
+			t.Errorf("RepoSizes.Set(%q) error: %v", value, err)
+		}
+	}
+	if want := (RepoSizes{"r": 100 << 20, "other": 0}); !reflect.DeepEqual(quotas, want) {
+		t.Errorf("RepoSizes = %#v, want %#v", quotas, want)
+	}
+	for _, value := range []string{"r=1G", "x=1X", "x", "=1G"} {
+		if err := quotas.Set(value); err == nil {
+			t.Errorf("RepoSizes.Set(%q), want error", value)
+		}
+	}
+}
+
+func TestCachePoliciesSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   CachePolicies
+		err    bool
+	}{
+		{
+			values: []string{`r=max_age=720h,min_age=1h:.*\.jar$`, "r=cache=false:^snapshots/", "other=pin=true,min_size=1K,max_size=2G:.*"},
+			want: CachePolicies{
+				"r": {
+					{Regexp: `.*\.jar$`, MaxAge: 720 * time.Hour, MinAge: time.Hour},
+					{Regexp: "^snapshots/", NoCache: true},
+				},
+				"other": {{Regexp: ".*", Pin: true, MinSize: 1 << 10, MaxSize: 2 << 30}},
+			},
+		},
+		// Regular expression containing : and =.
+		{values: []string{"r=cache=true:^a:b=c$"}, want: CachePolicies{"r": {{Regexp: "^a:b=c$"}}}},
+		{values: []string{"r=max_age=1h"}, err: true},
+		{values: []string{"r=max_age=1h:"}, err: true},
+		{values: []string{"r=max_age=1h:["}, err: true},
+		{values: []string{"r=:.*"}, err: true},
+		{values: []string{"r=max_age=:.*"}, err: true},
+		{values: []string{"r=max_age=1:.*"}, err: true},
+		{values: []string{"r=pin=maybe:.*"}, err: true},
+		{values: []string{"r=max_size=1X:.*"}, err: true},
+		{values: []string{"r=ttl=1h:.*"}, err: true},
+	}
+	for _, test := range tests {
+		policies := CachePolicies{}
+		var err error
+		for _, value := range test.values {
+			if err = policies.Set(value); err != nil {
+				break
+			}
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("Set(%q) = %#v, want error", test.values, policies)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) error: %v", test.values, err)
+		} else if !reflect.DeepEqual(policies, test.want) {
+			t.Errorf("Set(%q) = %#v, want %#v", test.values, policies, test.want)
+		}
+	}
+}
+
+func TestUpstreamClientOptionsSet(t *testing.T) {
+	want := defaultUpstreamClientOption()
+	want.ResponseHeaderTimeout = 5 * time.Minute
+	want.MaxConnsPerHost = 64
+	want.Retries = 10
+	want.MaxBackoff = time.Minute
+	options := UpstreamClientOptions{}
+	if err := options.Set("r=header_timeout=5m,max_conns=64,retries=10,max_backoff=1m"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(options["r"], want) {
+		t.Errorf("Set() = %#v, want %#v", options["r"], want)
+	}
+	for _, value := range []string{
+		"r=retries=11",
+		"r=retries=-1",
+		"r=max_conns=x",
+		"r=connect_timeout=-1s",
+		"r=retry_backoff=1m",
+		"r=retry_backoff=1s,max_backoff=500ms",
+		"r=backoff=1s",
+	} {
+		if err := (&UpstreamClientOptions{}).Set(value); err == nil {
+			t.Errorf("Set(%q), want error", value)
+		}
+	}
+}
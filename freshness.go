@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mutableRule marks files matching regexp as mutable upstream (i.e.
+// maven-metadata.xml, index.yaml, Packages), and how long cached copy is
+// considered fresh. After that, cache hit checks with upstream if the file
+// changed, using conditional request.
+type mutableRule struct {
+	re     *regexp.Regexp
+	maxAge time.Duration
+}
+
+// cacheControl is parsed Cache-Control header of upstream response.
+// Durations are -1 if not present.
+type cacheControl struct {
+	noStore              bool
+	noCache              bool
+	private              bool
+	immutable            bool
+	maxAge               time.Duration
+	sMaxAge              time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+func parseCacheControl(header string) cacheControl {
+	cc := cacheControl{
+		maxAge:               -1,
+		sMaxAge:              -1,
+		staleWhileRevalidate: -1,
+		staleIfError:         -1,
+	}
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		name = strings.ToLower(name)
+		seconds := func() time.Duration {
+			n, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || n < 0 {
+				// Invalid values are treated as stale (RFC 9111 4.2.1).
+				return 0
+			}
+			return time.Duration(n) * time.Second
+		}
+		switch name {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "immutable":
+			cc.immutable = true
+		case "max-age":
+			cc.maxAge = seconds()
+		case "s-maxage":
+			cc.sMaxAge = seconds()
+		case "stale-while-revalidate":
+			cc.staleWhileRevalidate = seconds()
+		case "stale-if-error":
+			cc.staleIfError = seconds()
+		}
+	}
+	return cc
+}
+
+// isCacheable checks if upstream allows storing the response in a shared
+// cache.
+func isCacheable(meta *CacheMeta) bool {
+	cc := parseCacheControl(meta.CacheControl)
+	return !cc.noStore && !cc.private
+}
+
+// cacheAge returns how long ago the cached file was fetched (or last
+// revalidated) from upstream.
+func cacheAge(meta *CacheMeta, cache *os.File) time.Duration {
+	if meta != nil && !meta.FetchTime.IsZero() {
+		return time.Since(meta.FetchTime)
+	}
+	fi, err := cache.Stat()
+	if err != nil {
+		return 0
+	}
+	return time.Since(fi.ModTime())
+}
+
+// freshnessLifetime returns for how long after fetching, the cached file is
+// fresh. First matching mutable rule is used, then upstream Cache-Control
+// and Expires headers. Returns false if the file never becomes stale.
+func (repo *Repo) freshnessLifetime(filename string, meta *CacheMeta) (time.Duration, bool) {
+	for _, rule := range repo.mutableRules {
+		if rule.re.MatchString(filename) {
+			return rule.maxAge, true
+		}
+	}
+	if meta == nil {
+		return 0, false
+	}
+	cc := parseCacheControl(meta.CacheControl)
+	switch {
+	case cc.immutable:
+		return 0, false
+	case cc.noCache:
+		return 0, true
+	case cc.sMaxAge >= 0:
+		return cc.sMaxAge, true
+	case cc.maxAge >= 0:
+		return cc.maxAge, true
+	case meta.Expires != "":
+		expires, err := http.ParseTime(meta.Expires)
+		if err != nil || expires.Before(meta.FetchTime) {
+			// Invalid dates (i.e. "0") mean already expired.
+			return 0, true
+		}
+		return expires.Sub(meta.FetchTime), true
+	}
+	return 0, false
+}
+
+type freshness int
+
+const (
+	cacheFresh freshness = iota
+	// Stale, but can be served while revalidating in the background
+	// (stale-while-revalidate).
+	cacheStaleRevalidateInBackground
+	cacheStale
+)
+
+// checkFreshness checks if cached file needs to be revalidated with upstream.
+func (repo *Repo) checkFreshness(filename string, meta *CacheMeta, cache *os.File) freshness {
+	lifetime, ok := repo.freshnessLifetime(filename, meta)
+	if !ok {
+		return cacheFresh
+	}
+	staleness := cacheAge(meta, cache) - lifetime
+	if staleness <= 0 {
+		return cacheFresh
+	}
+	if meta != nil {
+		if cc := parseCacheControl(meta.CacheControl); staleness <= cc.staleWhileRevalidate {
+			return cacheStaleRevalidateInBackground
+		}
+	}
+	return cacheStale
+}
+
+// canServeStaleOnError checks if upstream allows serving stale cached file,
+// when revalidation fails. Without stale-if-error from upstream, it is
+// always allowed.
+func (repo *Repo) canServeStaleOnError(filename string, meta *CacheMeta, cache *os.File) bool {
+	if meta == nil {
+		return true
+	}
+	cc := parseCacheControl(meta.CacheControl)
+	if cc.staleIfError < 0 {
+		return true
+	}
+	lifetime, _ := repo.freshnessLifetime(filename, meta)
+	return cacheAge(meta, cache)-lifetime <= cc.staleIfError
+}
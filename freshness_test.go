@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		header string
+		want   cacheControl
+	}{
+		{"", cacheControl{maxAge: -1, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1}},
+		{"max-age=60", cacheControl{maxAge: time.Minute, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1}},
+		{`Max-Age="60", S-MAXAGE=10`, cacheControl{maxAge: time.Minute, sMaxAge: 10 * time.Second, staleWhileRevalidate: -1, staleIfError: -1}},
+		{"no-store, no-cache, private, immutable", cacheControl{noStore: true, noCache: true, private: true, immutable: true, maxAge: -1, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1}},
+		{"max-age=10, stale-while-revalidate=30, stale-if-error=86400", cacheControl{maxAge: 10 * time.Second, sMaxAge: -1, staleWhileRevalidate: 30 * time.Second, staleIfError: 24 * time.Hour}},
+		// Invalid values mean stale.
+		{"max-age=-5", cacheControl{maxAge: 0, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1}},
+		{"max-age=abc, public, must-revalidate", cacheControl{maxAge: 0, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1}},
+	}
+	for _, test := range tests {
+		if got := parseCacheControl(test.header); got != test.want {
+			t.Errorf("parseCacheControl(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestIsCacheable(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         bool
+	}{
+		{"", true},
+		{"max-age=0", true},
+		{"no-cache", true},
+		{"no-store", false},
+		{"private, max-age=60", false},
+	}
+	for _, test := range tests {
+		if got := isCacheable(&CacheMeta{CacheControl: test.cacheControl}); got != test.want {
+			t.Errorf("isCacheable(%q) = %v, want %v", test.cacheControl, got, test.want)
+		}
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	cache, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	repo := &Repo{
+		mutableRules: []mutableRule{{re: regexp.MustCompile(`maven-metadata\.xml$`), maxAge: time.Hour}},
+	}
+	now := time.Now()
+	tests := []struct {
+		filename string
+		meta     *CacheMeta
+		want     freshness
+	}{
+		// No freshness information, never stale.
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-24 * time.Hour)}, cacheFresh},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-30 * time.Second), CacheControl: "max-age=60"}, cacheFresh},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-2 * time.Minute), CacheControl: "max-age=60"}, cacheStale},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-2 * time.Minute), CacheControl: "max-age=600, s-maxage=60"}, cacheStale},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-2 * time.Minute), CacheControl: "max-age=60, stale-while-revalidate=120"}, cacheStaleRevalidateInBackground},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-5 * time.Minute), CacheControl: "max-age=60, stale-while-revalidate=120"}, cacheStale},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-time.Second), CacheControl: "no-cache"}, cacheStale},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-24 * time.Hour), CacheControl: "immutable, max-age=60"}, cacheFresh},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-time.Minute), Expires: now.Add(time.Hour).UTC().Format(http.TimeFormat)}, cacheFresh},
+		{"a.jar", &CacheMeta{FetchTime: now.Add(-time.Minute), Expires: "0"}, cacheStale},
+		// Mutable rules take precedence over upstream headers.
+		{"g/maven-metadata.xml", &CacheMeta{FetchTime: now.Add(-30 * time.Minute), CacheControl: "max-age=60"}, cacheFresh},
+		{"g/maven-metadata.xml", &CacheMeta{FetchTime: now.Add(-2 * time.Hour), CacheControl: "immutable"}, cacheStale},
+	}
+	for _, test := range tests {
+		if got := repo.checkFreshness(test.filename, test.meta, cache); got != test.want {
+			t.Errorf("checkFreshness(%q, %+v) = %v, want %v", test.filename, test.meta, got, test.want)
+		}
+	}
+}
+
+func TestCanServeStaleOnError(t *testing.T) {
+	repo := &Repo{}
+	now := time.Now()
+	tests := []struct {
+		meta *CacheMeta
+		want bool
+	}{
+		{nil, true},
+		{&CacheMeta{FetchTime: now.Add(-24 * time.Hour), CacheControl: "max-age=60"}, true},
+		{&CacheMeta{FetchTime: now.Add(-2 * time.Minute), CacheControl: "max-age=60, stale-if-error=120"}, true},
+		{&CacheMeta{FetchTime: now.Add(-5 * time.Minute), CacheControl: "max-age=60, stale-if-error=120"}, false},
+	}
+	for _, test := range tests {
+		if got := repo.canServeStaleOnError("a.jar", test.meta, nil); got != test.want {
+			t.Errorf("canServeStaleOnError(%+v) = %v, want %v", test.meta, got, test.want)
+		}
+	}
+}
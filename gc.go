@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,14 +19,39 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 	removedCount := 0
 	bytesSum := int64(0)
 	removedBytesSum := int64(0)
+	// Files in final/ still in the cache, see accessIndex.prune.
+	var seen map[string]bool
 
-	walkerFactory := func(repo *Repo) func(path string, d fs.DirEntry, err error) error {
+	walkerFactory := func(reponame string, repo *Repo) func(path string, d fs.DirEntry, err error) error {
+		finalPrefix := "cache/" + reponame + "/final/"
 		return func(path string, d fs.DirEntry, err error) error {
 			if d.IsDir() {
+				if path == "cache/"+reponame+"/meta" {
+					// Removed together with the files in final/.
+					return filepath.SkipDir
+				}
+				if path == "cache/"+reponame+"/negative" {
+					// Expired separately, see gcNegative.
+					return filepath.SkipDir
+				}
+				if path == "cache/"+reponame+"/access" || path == "cache/"+reponame+"/listing" {
+					// See access.go and listing.go.
+					return filepath.SkipDir
+				}
+				if path == "cache/"+reponame+"/temp" {
+					// Removed when stale, see cleanup.go.
+					return filepath.SkipDir
+				}
 				dirCount++
 				return nil
 			}
 			basename := d.Name()
+			if basename == "vary" && strings.HasSuffix(filepath.Dir(path), varyDirSuffix) {
+				// Never served, so not aged. Variants are walked before it,
+				// so it is removed after the last one, see vary.go.
+				repo.removeUnusedVary(reponame, strings.TrimSuffix(strings.TrimPrefix(filepath.Dir(path), finalPrefix), varyDirSuffix))
+				return nil
+			}
 			fi, err := d.Info()
 			if errors.Is(err, os.ErrNotExist) {
 				return nil
@@ -47,20 +73,55 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 			//                      Mtim:syscall.Timespec{Sec:1659390279, Nsec:0},
 			//                      Ctim:syscall.Timespec{Sec:1659390279, Nsec:0}, X__unused:[3]int64{0, 0, 0}}}
 			_ = basename
-			delete := true
 			mtime := fi.ModTime()
-			if !(time.Since(mtime) > repo.gcMaxAge) {
+			maxAge := repo.gcMaxAge
+			inFinal := strings.HasPrefix(path, finalPrefix)
+			if inFinal {
+				filename := strings.TrimPrefix(path, finalPrefix)
+				seen[filename] = true
+				policy := repo.cachePolicy(filename)
+				maxAge = policy.gcMaxAge(repo)
+				if !policy.canRemove(mtime) {
+					maxAge = 0
+				} else if repo.gcDeleteUnlisted > 0 && repo.listing.deletedUpstream(filename, mtime, repo.gcDeleteUnlisted) {
+					log.Printf("gc: Walker: path: %q  not listed upstream for more than %s - REMOVING", path, repo.gcDeleteUnlisted)
+					if err := os.Remove(path); err != nil {
+						gc_error_count.Inc()
+						log.Printf("gc: Walker: path: %q Error, while removing: %v", path, err)
+						bytesSum += fi.Size()
+						return nil
+					}
+					removedBytesSum += fi.Size()
+					removedCount++
+					gc_upstream_deleted_count.Inc()
+					removeCacheMeta(reponame, filename)
+					seen[filename] = false
+					return nil
+				}
+				if repo.gcKeepListed && repo.listing.listed(filename) {
+					// Still upstream.
+					maxAge = 0
+				}
+			}
+			if maxAge == 0 {
+				// Kept forever, or at least for now.
+				bytesSum += fi.Size()
+				return nil
+			}
+			delete := true
+			if !(time.Since(mtime) > maxAge) {
+				delete = false
+			}
+			// Last access from the access index, if known.
+			atime := repo.lastAccess(strings.TrimPrefix(path, finalPrefix), fi)
+			if !(time.Since(atime) > maxAge) {
 				delete = false
 			}
 			stat := fi.Sys().(*syscall.Stat_t)
-			var atime, ctime time.Time
+			var ctime time.Time
 			if stat != nil {
-				atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
-				if !(time.Since(atime) > repo.gcMaxAge) {
-					delete = false
-				}
 				ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
-				if !(time.Since(ctime) > repo.gcMaxAge) {
+				if !(time.Since(ctime) > maxAge) {
 					delete = false
 				}
 			}
@@ -69,11 +130,15 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 				err = os.Remove(path)
 				if err != nil {
 					gc_error_count.Inc()
-					log.Printf("gc: Walker: path: %q Error, while removing: %v", err)
+					log.Printf("gc: Walker: path: %q Error, while removing: %v", path, err)
 					bytesSum += fi.Size()
 				} else {
 					removedBytesSum += fi.Size()
 					removedCount++
+					if inFinal {
+						removeCacheMeta(reponame, strings.TrimPrefix(path, finalPrefix))
+						seen[strings.TrimPrefix(path, finalPrefix)] = false
+					}
 				}
 				return nil
 			} else {
@@ -85,7 +150,10 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 	}
 
 	updater := func(reponame string, repo *Repo) {
-		if repo.gcMaxAge == 0 {
+		if repo.negativeTTL > 0 {
+			negative_entries.WithLabelValues(reponame).Set(float64(gcNegative(reponame, repo)))
+		}
+		if !repo.hasGC() {
 			log.Printf("gc: gc skipped for %s", reponame)
 			return
 		}
@@ -106,8 +174,11 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 		dirCount = 0
 		bytesSum = 0
 		removedBytesSum = 0
-		if err := filepath.WalkDir("cache/"+reponame, walkerFactory(repo)); err != nil {
+		seen = make(map[string]bool)
+		if err := filepath.WalkDir("cache/"+reponame, walkerFactory(reponame, repo)); err != nil {
 			log.Printf("gc: Error walking cache: %v", err)
+		} else {
+			repo.access.prune(seen, t1)
 		}
 		gc_final_size.Set(float64(bytesSum))
 		gc_final_count.Set(float64(fileCount - removedCount))
@@ -116,12 +187,31 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 		log.Printf("gc: gc finished scanning %d directories and %d files (%d bytes remaining) in %s. %d files (%d bytes) removed.", dirCount, fileCount, bytesSum, time.Since(t1), removedCount, removedBytesSum)
 	}
 
+	var lastEviction time.Time
+	evictionScheduled := false
+	evictor := func() {
+		if !evictionEnabled(repos) {
+			return
+		}
+		lastEviction = time.Now()
+		evictionScheduled = false
+		runEviction(repos)
+	}
+	saveAccess := func() {
+		if *accessIndexInterval <= 0 {
+			// Not saved periodically, see startAccessIndexLoop.
+			saveAccessIndexes(repos)
+		}
+	}
+
 	stopChan := make(chan bool)
 
 	go func() {
 		for reponame, repo := range repos {
 			updater(reponame, repo)
 		}
+		evictor()
+		saveAccess()
 		ticker := time.NewTicker(60 * time.Second)
 		for {
 			select {
@@ -132,6 +222,18 @@ func startGCLoop(repos map[string]*Repo) chan bool {
 				for reponame, repo := range repos {
 					updater(reponame, repo)
 				}
+				evictor()
+				saveAccess()
+			case <-evictionRequests:
+				if wait := minEvictionInterval - time.Since(lastEviction); wait > 0 {
+					if !evictionScheduled {
+						evictionScheduled = true
+						time.AfterFunc(wait, requestEviction)
+					}
+					continue
+				}
+				evictor()
+				saveAccess()
 			case <-stopChan:
 				ticker.Stop()
 				return
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Headers managed by the proxy itself, or specific to a single connection,
+// which cannot be forwarded in either direction.
+var unforwardableHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Range":               true,
+	"If-Range":            true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+	"Authorization":       true,
+	"Etag":                true,
+	"Last-Modified":       true,
+	"Set-Cookie":          true,
+	"Forwarded":           true,
+	"X-Forwarded-For":     true,
+	"Via":                 true,
+}
+
+const viaValue = "1.1 nexus-proxy"
+
+// forwardHeaders returns headers of the client request to send to upstream:
+// ones in the allowlist of the repo, and X-Forwarded-For, Forwarded and Via,
+// if enabled.
+func (repo *Repo) forwardHeaders(r *http.Request) http.Header {
+	forward := make(http.Header)
+	for _, name := range repo.forwardRequestHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			forward[name] = values
+		}
+	}
+	if repo.addForwardedHeaders {
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		xff := clientIP
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		forward.Set("X-Forwarded-For", xff)
+		forwardedFor := clientIP
+		if strings.Contains(clientIP, ":") {
+			forwardedFor = `"[` + clientIP + `]"`
+		}
+		forwarded := "for=" + forwardedFor + ";proto=http"
+		if r.Host != "" {
+			forwarded += `;host="` + r.Host + `"`
+		}
+		if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+		forward.Set("Forwarded", forwarded)
+		via := viaValue
+		if prior := r.Header.Values("Via"); len(prior) > 0 {
+			via = strings.Join(prior, ", ") + ", " + via
+		}
+		forward.Set("Via", via)
+	}
+	return forward
+}
+
+// fetchKey identifies a fetch. Requests for the same file, but selecting
+// different variants (see vary.go), do not share a fetch. Other forwarded
+// headers do not matter, so they do not prevent coalescing.
+func fetchKey(reponame, filename string, forward http.Header) string {
+	names, ok := readVaryNames(varyDir(reponame, filename))
+	if !ok {
+		return filename
+	}
+	return filename + "\x00" + varyKey(names, forward)
+}
+
+// setForwardHeaders sets headers on upstream request.
+func setForwardHeaders(req *http.Request, forward http.Header) {
+	for name, values := range forward {
+		req.Header[name] = values
+	}
+}
+
+// responseHeaders returns upstream response headers in the allowlist of the
+// repo, to send to clients (and to store in the cache metadata).
+func (repo *Repo) responseHeaders(header http.Header) map[string][]string {
+	var headers map[string][]string
+	for _, name := range repo.forwardResponseHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			if headers == nil {
+				headers = make(map[string][]string)
+			}
+			headers[name] = values
+		}
+	}
+	return headers
+}
+
+// canonicalHeaderNames canonicalizes comma separated list of header names.
+// Returns the invalid name, if any.
+func canonicalHeaderNames(list string) ([]string, string) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if len(name) == 0 || strings.ContainsAny(name, " \t:") || unforwardableHeaders[name] {
+			return nil, name
+		}
+		names = append(names, name)
+	}
+	return names, ""
+}
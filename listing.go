@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamListing records files listed upstream by the prefetcher (Nexus
+// assets listing, or generic crawl), so GC can keep files which are still
+// upstream (--gc_keep_listed), and remove files deleted upstream
+// (--gc_delete_unlisted).
+//
+// Each listing has an id, which is the (unix) time it started. For every
+// file, id of the last listing it was seen in is recorded. Files are known
+// to be deleted upstream only if a complete listing (one which did not fail
+// midway) did not include them. For generic crawl, this only applies to
+// files in directories which were listed by the crawl, as other
+// directories are not crawled (i.e. excluded by --prefetch_exclude).
+//
+// It is saved to cache/REPO/listing/index after every listing, as text
+// lines: "complete ID", "first ID", and "F ID FILENAME" or "D ID DIR/",
+// with tabs between fields.
+type upstreamListing struct {
+	path string
+	// All files of the repo are listed (Nexus), not only ones in listed
+	// directories (generic crawl).
+	full bool
+
+	mu    sync.Mutex
+	files map[string]int64
+	dirs  map[string]int64
+	// Last and first complete listing, 0 if none yet.
+	complete int64
+	first    int64
+}
+
+const upstreamListingHeader = "nexus-proxy listing 1"
+
+func upstreamListingPath(reponame string) string {
+	return "cache/" + reponame + "/listing/index"
+}
+
+// loadUpstreamListing reads the listing of the repo. Missing file is an
+// empty listing.
+func loadUpstreamListing(reponame string, full bool) (*upstreamListing, error) {
+	listing := &upstreamListing{
+		path:  upstreamListingPath(reponame),
+		full:  full,
+		files: make(map[string]int64),
+		dirs:  make(map[string]int64),
+	}
+	f, err := os.Open(listing.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return listing, nil
+	}
+	if err != nil {
+		return listing, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != upstreamListingHeader {
+		return listing, fmt.Errorf("Invalid header of listing %q", listing.path)
+	}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		var id int64
+		if len(fields) >= 2 {
+			id, err = strconv.ParseInt(fields[1], 10, 64)
+		}
+		if len(fields) < 2 || err != nil {
+			return listing, fmt.Errorf("Listing %q corrupted", listing.path)
+		}
+		switch {
+		case fields[0] == "complete":
+			listing.complete = id
+		case fields[0] == "first":
+			listing.first = id
+		case fields[0] == "F" && len(fields) == 3:
+			listing.files[fields[2]] = id
+		case fields[0] == "D" && len(fields) == 3:
+			listing.dirs[fields[2]] = id
+		default:
+			return listing, fmt.Errorf("Listing %q corrupted", listing.path)
+		}
+	}
+	return listing, scanner.Err()
+}
+
+// start returns id of a new listing.
+func (listing *upstreamListing) start() int64 {
+	return time.Now().Unix()
+}
+
+// add records file seen in the listing.
+func (listing *upstreamListing) add(id int64, filename string) {
+	if listing == nil {
+		return
+	}
+	listing.mu.Lock()
+	defer listing.mu.Unlock()
+	listing.files[filename] = id
+}
+
+// addDir records directory (with trailing /, "" for the top) listed by
+// generic crawl.
+func (listing *upstreamListing) addDir(id int64, dir string) {
+	if listing == nil {
+		return
+	}
+	listing.mu.Lock()
+	defer listing.mu.Unlock()
+	listing.dirs[dir] = id
+}
+
+// finish records end of the listing, and saves it. Entries not seen in a
+// complete listing for longer than keep are dropped.
+func (listing *upstreamListing) finish(id int64, complete bool, keep time.Duration) error {
+	if listing == nil {
+		return nil
+	}
+	listing.mu.Lock()
+	if complete {
+		listing.complete = id
+		if listing.first == 0 {
+			listing.first = id
+		}
+		for filename, seen := range listing.files {
+			if seen != id && time.Duration(id-seen)*time.Second > keep {
+				delete(listing.files, filename)
+			}
+		}
+		for dir, seen := range listing.dirs {
+			if seen != id {
+				delete(listing.dirs, dir)
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString(upstreamListingHeader + "\n")
+	fmt.Fprintf(&b, "complete\t%d\nfirst\t%d\n", listing.complete, listing.first)
+	for filename, seen := range listing.files {
+		fmt.Fprintf(&b, "F\t%d\t%s\n", seen, filename)
+	}
+	for dir, seen := range listing.dirs {
+		fmt.Fprintf(&b, "D\t%d\t%s\n", seen, dir)
+	}
+	listing.mu.Unlock()
+
+	temp := listing.path + ".new"
+	err := os.WriteFile(temp, []byte(b.String()), 0640)
+	if err == nil {
+		err = os.Rename(temp, listing.path)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// size returns number of files recorded.
+func (listing *upstreamListing) size() int {
+	if listing == nil {
+		return 0
+	}
+	listing.mu.Lock()
+	defer listing.mu.Unlock()
+	return len(listing.files)
+}
+
+// listed checks if the file was included in the last complete listing, or
+// any listing since then.
+func (listing *upstreamListing) listed(filename string) bool {
+	if listing == nil {
+		return false
+	}
+	filename = variantOf(filename)
+	listing.mu.Lock()
+	defer listing.mu.Unlock()
+	seen, ok := listing.files[filename]
+	return ok && listing.complete > 0 && seen >= listing.complete
+}
+
+// deletedUpstream checks if the file cached at cachedTime was not listed by
+// complete listings for longer than grace.
+func (listing *upstreamListing) deletedUpstream(filename string, cachedTime time.Time, grace time.Duration) bool {
+	if listing == nil {
+		return false
+	}
+	filename = variantOf(filename)
+	listing.mu.Lock()
+	defer listing.mu.Unlock()
+	if listing.complete == 0 {
+		return false
+	}
+	if !listing.full {
+		dir := ""
+		if i := strings.LastIndex(filename, "/"); i >= 0 {
+			dir = filename[:i+1]
+		}
+		if listing.dirs[dir] != listing.complete {
+			return false
+		}
+	}
+	// Known to exist upstream when it was cached, or at least not known to
+	// be missing before listings started.
+	lastSeen := max(listing.files[filename], listing.first, cachedTime.Unix())
+	return time.Duration(listing.complete-lastSeen)*time.Second > grace
+}
+
+// crawledFilename returns filename in the repo of URL found by generic
+// crawl, if it is on one of the upstream URLs.
+func (repo *Repo) crawledFilename(fileURL string) (string, bool) {
+	for _, u := range repo.upstreams {
+		if rest, ok := strings.CutPrefix(fileURL, u.base); ok {
+			filename, err := url.PathUnescape(rest)
+			if err != nil {
+				return "", false
+			}
+			return filename, true
+		}
+	}
+	return "", false
+}
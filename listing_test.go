@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpstreamListing(t *testing.T) {
+	chdirTestCache(t)
+	if err := os.MkdirAll("cache/r/listing", 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := loadUpstreamListing("r", false)
+	if err != nil || listing.size() != 0 || listing.complete != 0 {
+		t.Fatalf("Missing listing loaded as %#v, error %v", listing, err)
+	}
+	const first = int64(1000000)
+	listing.add(first, "a/x.jar")
+	listing.add(first, "a/y.jar")
+	listing.addDir(first, "")
+	listing.addDir(first, "a/")
+	if err := listing.finish(first, true, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// a/x.jar deleted upstream, and a/ not listed.
+	second := first + 3600
+	listing.add(second, "a/y.jar")
+	listing.addDir(second, "a/")
+	if err := listing.finish(second, true, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadUpstreamListing("r", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.complete != second || loaded.first != first ||
+		!reflect.DeepEqual(loaded.files, map[string]int64{"a/x.jar": first, "a/y.jar": second}) ||
+		!reflect.DeepEqual(loaded.dirs, map[string]int64{"a/": second}) {
+		t.Errorf("Loaded listing %#v", loaded)
+	}
+
+	for filename, want := range map[string]bool{
+		"a/x.jar":                        false,
+		"a/y.jar":                        true,
+		"a/y.jar" + varyDirSuffix + "/0": true,
+		"a/z.jar":                        false,
+	} {
+		if got := loaded.listed(filename); got != want {
+			t.Errorf("listed(%q) = %v, want %v", filename, got, want)
+		}
+	}
+
+	deletedTests := []struct {
+		filename string
+		cached   int64
+		grace    time.Duration
+		want     bool
+	}{
+		{"a/x.jar", first - 100, 30 * time.Minute, true},
+		{"a/x.jar", first - 100, 2 * time.Hour, false},
+		{"a/y.jar", first - 100, 0, false},
+		// Never listed, cached before listings started.
+		{"a/z.jar", first - 100, 30 * time.Minute, true},
+		// Cached after the last complete listing.
+		{"a/z.jar", second + 1, 0, false},
+		// Directory not listed by the crawl.
+		{"x.jar", first - 100, 0, false},
+		{"b/x.jar", first - 100, 0, false},
+	}
+	for _, test := range deletedTests {
+		if got := loaded.deletedUpstream(test.filename, time.Unix(test.cached, 0), test.grace); got != test.want {
+			t.Errorf("deletedUpstream(%q, %d, %s) = %v, want %v", test.filename, test.cached, test.grace, got, test.want)
+		}
+	}
+	loaded.full = true
+	if !loaded.deletedUpstream("b/x.jar", time.Unix(first-100, 0), 0) {
+		t.Errorf("deletedUpstream() = false for file not in a full listing")
+	}
+
+	// Incomplete listing does not change what is known to be deleted.
+	third := second + 3600
+	loaded.add(third, "a/z.jar")
+	if err := loaded.finish(third, false, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.complete != second || !loaded.listed("a/z.jar") || !loaded.deletedUpstream("a/x.jar", time.Unix(first-100, 0), 0) {
+		t.Errorf("Listing after incomplete listing %#v", loaded)
+	}
+
+	// Files not seen for longer than keep are dropped.
+	fourth := second + 24*3600
+	if err := loaded.finish(fourth, true, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"a/y.jar": second, "a/z.jar": third}; !reflect.DeepEqual(loaded.files, want) {
+		t.Errorf("Files after keep expired %v, want %v", loaded.files, want)
+	}
+}
+
+func TestLoadUpstreamListingInvalid(t *testing.T) {
+	chdirTestCache(t)
+	if err := os.MkdirAll("cache/r/listing", 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{
+		"",
+		"nexus-proxy listing 2\n",
+		upstreamListingHeader + "\ncomplete\n",
+		upstreamListingHeader + "\ncomplete\tx\n",
+		upstreamListingHeader + "\nF\t1\n",
+		upstreamListingHeader + "\nX\t1\ta\n",
+	} {
+		if err := os.WriteFile(upstreamListingPath("r"), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadUpstreamListing("r", true); err == nil {
+			t.Errorf("loadUpstreamListing() of %q, want error", content)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CacheMeta is metadata of a cached file, recorded from the upstream
+// response at the time the file was fetched.
+//
+// It is stored as JSON in extended attribute of the cached file, so it is
+// always consistent with the file content (it is set on the temporary file,
+// before moving it to final/). If the file system does not support extended
+// attributes (or value is too big), it is stored in a sidecar file instead,
+// in a parallel directory tree cache/REPO/meta/ (so final/ contains only
+// files from upstream).
+type CacheMeta struct {
+	URL                string            `json:"url"`
+	FetchTime          time.Time         `json:"fetch_time"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"content_type,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+	LastModified       string            `json:"last_modified,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	Expires            string            `json:"expires,omitempty"`
+	Checksums          map[string]string `json:"checksums,omitempty"`
+	// Other upstream response headers to send to clients, see
+	// --forward_response_headers.
+	Headers map[string][]string `json:"headers,omitempty"`
+	// URLs which were redirected to URL, starting with the original one.
+	Redirects []string `json:"redirects,omitempty"`
+}
+
+const metaXattrName = "user.nexus_proxy.meta"
+
+func newCacheMeta(upstreamURL string, resp *http.Response) *CacheMeta {
+	return &CacheMeta{
+		URL:                upstreamURL,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ETag:               resp.Header.Get("ETag"),
+		LastModified:       resp.Header.Get("Last-Modified"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		CacheControl:       strings.Join(resp.Header.Values("Cache-Control"), ", "),
+		Expires:            resp.Header.Get("Expires"),
+	}
+}
+
+// setMetaHeaders sets response headers, as recorded from the upstream.
+// Without metadata, Content-Type will be guessed by http.ServeContent.
+func setMetaHeaders(header http.Header, meta *CacheMeta) {
+	if meta == nil {
+		return
+	}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	if meta.ContentDisposition != "" {
+		header.Set("Content-Disposition", meta.ContentDisposition)
+	}
+	if etag := cacheETag(meta); etag != "" {
+		header.Set("ETag", etag)
+	}
+	for name, values := range meta.Headers {
+		header[name] = values
+	}
+}
+
+// cacheETag returns ETag of cached file. Either one received from the
+// upstream, or based on the content hash. Empty if not known.
+func cacheETag(meta *CacheMeta) string {
+	if meta == nil {
+		return ""
+	}
+	if meta.ETag != "" {
+		return meta.ETag
+	}
+	if sum := meta.Checksums["sha256"]; sum != "" {
+		return `"sha256-` + sum + `"`
+	}
+	return ""
+}
+
+// cacheModTime returns last modification time of the cached file, as reported
+// by upstream, or if not known, time file was put in the cache.
+func cacheModTime(meta *CacheMeta, fi os.FileInfo) time.Time {
+	if meta != nil && meta.LastModified != "" {
+		if t, err := http.ParseTime(meta.LastModified); err == nil {
+			return t
+		}
+	}
+	if fi != nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func metaSidecarPath(reponame, filename string) string {
+	return "cache/" + reponame + "/meta/" + filename
+}
+
+// writeCacheMeta stores metadata for a (temporary) cache file.
+func writeCacheMeta(f *os.File, reponame, filename string, meta *CacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	sidecarPath := metaSidecarPath(reponame, filename)
+	err = unix.Fsetxattr(int(f.Fd()), metaXattrName, data, 0)
+	if err == nil {
+		// Remove possibly stale sidecar of previous version of the file.
+		os.Remove(sidecarPath)
+		return nil
+	}
+	if err != unix.ENOTSUP && err != unix.E2BIG && err != unix.ENOSPC && err != unix.ERANGE {
+		return &os.PathError{Op: "fsetxattr", Path: f.Name(), Err: err}
+	}
+
+	// Fallback to sidecar file.
+	err = os.MkdirAll(filepath.Dir(sidecarPath), 0750)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(sidecarPath+".new", data, 0640)
+	if err == nil {
+		err = os.Rename(sidecarPath+".new", sidecarPath)
+	}
+	if err != nil {
+		os.Remove(sidecarPath + ".new")
+	}
+	return err
+}
+
+// readCacheMeta reads metadata of an open cache file. Returns nil metadata
+// and no error, if there is no metadata (i.e. file was put in the cache
+// externally).
+func readCacheMeta(f *os.File, reponame, filename string) (*CacheMeta, error) {
+	var data []byte
+	fd := int(f.Fd())
+	size, err := unix.Fgetxattr(fd, metaXattrName, nil)
+	if err == nil {
+		data = make([]byte, size)
+		size, err = unix.Fgetxattr(fd, metaXattrName, data)
+		data = data[:size]
+	}
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		data, err = os.ReadFile(metaSidecarPath(reponame, filename))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &CacheMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	// Sidecar could be a stale one, if file was replaced externally.
+	if fi, err := f.Stat(); err == nil && fi.Size() != meta.Size {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// touchCacheMeta marks cached file as just fetched from upstream, after
+// upstream confirmed it is not modified. Freshness headers are updated from
+// the 304 response.
+func touchCacheMeta(reponame, filename, cacheFilename string, meta *CacheMeta, header http.Header) error {
+	now := time.Now()
+	if meta == nil {
+		// No metadata (i.e. file put in the cache externally), so modification
+		// time of the file is used instead.
+		return os.Chtimes(cacheFilename, time.Time{}, now)
+	}
+	f, err := os.Open(cacheFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	updated := *meta
+	updated.FetchTime = now
+	if values := header.Values("Cache-Control"); len(values) > 0 {
+		updated.CacheControl = strings.Join(values, ", ")
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		updated.Expires = expires
+	}
+	return writeCacheMeta(f, reponame, filename, &updated)
+}
+
+// removeCacheMeta removes sidecar metadata file, if any. Used when the
+// cached file is removed.
+func removeCacheMeta(reponame, filename string) {
+	os.Remove(metaSidecarPath(reponame, filename))
+}
+
+// checksums computes checksums of the file content while it is being
+// written. Names are the same as used by Nexus.
+type checksums map[string]hash.Hash
+
+func newChecksums() checksums {
+	return checksums{
+		"md5":    md5.New(),
+		"sha1":   sha1.New(),
+		"sha256": sha256.New(),
+	}
+}
+
+func (c checksums) Write(p []byte) (int, error) {
+	for _, h := range c {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (c checksums) Sums() map[string]string {
+	sums := make(map[string]string, len(c))
+	for name, h := range c {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
@@ -36,6 +36,138 @@ var (
 		Name: "nexus_proxy_miss_bytes",
 		Help: "The total number bytes served from upstream (and saved in local cache, even if ended in error)",
 	})
+	coalesced_miss_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_coalesced_miss_count",
+		Help: "The total number of cache misses that joined already in-progress upstream fetch of the same file",
+	})
+	fetches_in_progress = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nexus_proxy_fetches_in_progress",
+		Help: "Number of upstream fetches to the cache in progress right now (each possibly serving multiple clients)",
+	})
+	upstream_fetch_bytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_fetch_bytes",
+		Help: "The total number of bytes received from upstream by cache misses (not including prefetcher listing)",
+	})
+	head_miss_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_head_miss_count",
+		Help: "The total number of HEAD requests for files not in cache, forwarded to upstream",
+	})
+	partial_saved_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_partial_saved_count",
+		Help: "The total number of interrupted upstream fetches, with partial data kept for resuming later",
+	})
+	fetch_resume_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_fetch_resume_count",
+		Help: "The total number of upstream fetches resumed from previously saved partial data",
+	})
+	partial_response_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_partial_response_count",
+		Help: "The total number of 206 Partial Content responses to ranged requests (cache hits and misses)",
+	})
+	not_modified_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_not_modified_count",
+		Help: "The total number of 304 Not Modified responses to conditional requests",
+	})
+	precondition_failed_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_precondition_failed_count",
+		Help: "The total number of 412 Precondition Failed responses to conditional requests",
+	})
+	revalidation_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_revalidation_count",
+		Help: "The total number of cache hits of stale mutable files, revalidated with upstream",
+	})
+	revalidation_refresh_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_revalidation_refresh_count",
+		Help: "The total number of revalidations, where file changed upstream and was fetched again",
+	})
+	revalidation_error_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_revalidation_error_count",
+		Help: "The total number of revalidations that failed, with stale file served instead",
+	})
+	stale_while_revalidate_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_stale_while_revalidate_count",
+		Help: "The total number of stale cache hits served immediately, while revalidating in background (stale-while-revalidate)",
+	})
+	uncacheable_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_uncacheable_count",
+		Help: "The total number of upstream responses not stored in the cache due to Cache-Control no-store or private",
+	})
+	stale_served_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_stale_served_count",
+		Help: "The total number of stale cached files served, due to failed revalidation, stale-while-revalidate or offline mode",
+	})
+	offline_miss_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_offline_miss_count",
+		Help: "The total number of cache misses in offline mode repos, responded with 404",
+	})
+	negative_hit_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_negative_hit_count",
+		Help: "The total number of requests answered from negative cache (404 or 410 previously received from upstream)",
+	})
+	negative_store_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_negative_store_count",
+		Help: "The total number of upstream 404 or 410 responses stored in negative cache",
+	})
+	negative_entries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_negative_entries",
+		Help: "Number of entries in negative cache of the repo, as of last gc loop",
+	}, []string{"repo"})
+	upstream_healthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_upstream_healthy",
+		Help: "1 if upstream URL (mirror) is healthy, 0 otherwise",
+	}, []string{"repo", "upstream"})
+	upstream_resolved = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_upstream_resolved",
+		Help: "1 if hostname of upstream URL (mirror) could be resolved on last try, 0 otherwise",
+	}, []string{"repo", "upstream"})
+	upstream_resolve_error_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_resolve_error_count",
+		Help: "Number of failed resolutions of upstream hostnames",
+	})
+	upstream_failure_count = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_failure_count",
+		Help: "Number of failed requests (connection errors and 5xx responses, including health checks) to upstream URL (mirror)",
+	}, []string{"repo", "upstream"})
+	upstream_failover_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_failover_count",
+		Help: "Number of upstream requests retried on the next mirror",
+	})
+	upstream_circuit_state = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_upstream_circuit_state",
+		Help: "State of circuit breaker of upstream URL (mirror). 0 closed, 1 open, 2 half-open",
+	}, []string{"repo", "upstream"})
+	circuit_open_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_circuit_open_count",
+		Help: "Number of times a circuit breaker opened",
+	})
+	circuit_rejected_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_circuit_rejected_count",
+		Help: "Number of upstream requests not made, because circuit breakers of all upstream URLs of a repo were open",
+	})
+	upstream_retry_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_retry_count",
+		Help: "Number of retried upstream requests, after connection errors or 502, 503, 504 responses",
+	})
+	upstream_idle_timeout_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_idle_timeout_count",
+		Help: "Number of upstream responses aborted, because upstream stopped sending data",
+	})
+	upstream_tls_pin_error_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_tls_pin_error_count",
+		Help: "Number of upstream TLS connections rejected, because no certificate matched pinned public keys",
+	})
+	upstream_redirect_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_upstream_redirect_count",
+		Help: "Number of upstream redirects followed",
+	})
+	redirect_rejected_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_redirect_rejected_count",
+		Help: "Number of upstream redirects not followed, because of too many hops or a host not allowed by redirect policy",
+	})
+	redirect_relayed_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_redirect_relayed_count",
+		Help: "Number of upstream redirects relayed to clients",
+	})
 	error_count = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "nexus_proxy_error_count",
 		Help: "The total number of errors - including client bad requests, bad repo, disconnection, upstream 404, etc.",
@@ -118,6 +250,38 @@ var (
 		Help: "How much time the last gc loop took",
 	})
 	// last_successfull_gc_timestamp
+	evicted_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_evicted_count",
+		Help: "Number of files evicted from the cache, because of quota or low disk space",
+	})
+	evicted_bytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_evicted_bytes",
+		Help: "Size of files evicted from the cache, because of quota or low disk space",
+	})
+	cache_size_bytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_cache_size_bytes",
+		Help: "Size of files in the cache of the repo, as of the last eviction check",
+	}, []string{"repo"})
+	access_index_entries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_access_index_entries",
+		Help: "Number of cached files with recorded last access time",
+	}, []string{"repo"})
+	upstream_listed_files = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nexus_proxy_upstream_listed_files",
+		Help: "Number of files recorded as listed upstream by the prefetcher",
+	}, []string{"repo"})
+	gc_upstream_deleted_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_gc_upstream_deleted_count",
+		Help: "Number of files removed from the cache, because they are no longer listed upstream",
+	})
+	temp_removed_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_temp_removed_count",
+		Help: "Number of stale temporary files (including partial downloads) removed by cleanup",
+	})
+	empty_dirs_removed_count = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nexus_proxy_empty_dirs_removed_count",
+		Help: "Number of empty directories removed from the cache by cleanup",
+	})
 	gc_final_size = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "nexus_proxy_gc_final_files_size_bytes",
 		Help: "How many file bytes remaining in all directories",
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Negative cache entry, recording that the file does not exist upstream
+// (404 or 410 response), so repeated requests for it do not go to upstream
+// until entry expires.
+//
+// Entries are stored in cache/REPO/negative/, separately from final/, with
+// hashed file names (so there are no conflicts between files and
+// directories with the same name). Modification time of the entry is when
+// it was stored.
+type negativeEntry struct {
+	Filename   string `json:"filename"`
+	StatusCode int    `json:"status_code"`
+}
+
+func negativePath(reponame, filename string) string {
+	sum := sha256.Sum256([]byte(filename))
+	return "cache/" + reponame + "/negative/" + hex.EncodeToString(sum[:])
+}
+
+// lookupNegative returns cached upstream status code for the file, or 0 if
+// there is no fresh negative entry.
+func (repo *Repo) lookupNegative(reponame, filename string) int {
+	if repo.negativeTTL <= 0 {
+		return 0
+	}
+	path := negativePath(reponame, filename)
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) > repo.negativeTTL {
+		return 0
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	entry := negativeEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Filename != filename {
+		return 0
+	}
+	return entry.StatusCode
+}
+
+// storeNegative records upstream 404 or 410 response for the file.
+func (repo *Repo) storeNegative(reponame, filename string, statusCode int) {
+	if repo.negativeTTL <= 0 {
+		return
+	}
+	if statusCode != 404 && statusCode != 410 {
+		return
+	}
+	data, err := json.Marshal(negativeEntry{
+		Filename:   filename,
+		StatusCode: statusCode,
+	})
+	if err != nil {
+		return
+	}
+	path := negativePath(reponame, filename)
+	err = os.WriteFile(path+".new", data, 0640)
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+	if err != nil {
+		os.Remove(path + ".new")
+		error_count.Inc()
+		log.Printf("negative: %s/%s Failed to store negative cache entry. Error: %v", reponame, filename, err)
+		return
+	}
+	negative_store_count.Inc()
+}
+
+func removeNegative(reponame, filename string) {
+	os.Remove(negativePath(reponame, filename))
+}
+
+// gcNegative removes expired negative cache entries. Returns number of
+// entries remaining.
+func gcNegative(reponame string, repo *Repo) int {
+	remaining := 0
+	removed := 0
+	dir := "cache/" + reponame + "/negative"
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(fi.ModTime()) > repo.negativeTTL {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				gc_error_count.Inc()
+				log.Printf("gc: Failed to remove expired negative cache entry %q. Error: %v", path, err)
+				remaining++
+			} else {
+				removed++
+			}
+			return nil
+		}
+		remaining++
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		gc_error_count.Inc()
+		log.Printf("gc: Error walking negative cache: %v", err)
+	}
+	if removed > 0 {
+		log.Printf("gc: Removed %d expired negative cache entries for %s, %d remaining", removed, reponame, remaining)
+	}
+	return remaining
+}
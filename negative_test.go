@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	chdirTestCache(t)
+	repo := &Repo{negativeTTL: time.Minute}
+
+	repo.storeNegative("r", "missing.jar", 404)
+	repo.storeNegative("r", "gone.jar", 410)
+	repo.storeNegative("r", "error.jar", 500)
+	tests := []struct {
+		filename string
+		want     int
+	}{
+		{"missing.jar", 404},
+		{"gone.jar", 410},
+		{"error.jar", 0},
+		{"other.jar", 0},
+	}
+	for _, test := range tests {
+		if got := repo.lookupNegative("r", test.filename); got != test.want {
+			t.Errorf("lookupNegative(%q) = %d, want %d", test.filename, got, test.want)
+		}
+	}
+	if got := (&Repo{}).lookupNegative("r", "missing.jar"); got != 0 {
+		t.Errorf("lookupNegative with negative caching disabled = %d, want 0", got)
+	}
+
+	removeNegative("r", "gone.jar")
+	if got := repo.lookupNegative("r", "gone.jar"); got != 0 {
+		t.Errorf("lookupNegative of removed entry = %d, want 0", got)
+	}
+
+	// Expired.
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(negativePath("r", "missing.jar"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.lookupNegative("r", "missing.jar"); got != 0 {
+		t.Errorf("lookupNegative of expired entry = %d, want 0", got)
+	}
+	repo.storeNegative("r", "fresh.jar", 404)
+	if remaining := gcNegative("r", repo); remaining != 1 {
+		t.Errorf("gcNegative remaining = %d, want 1", remaining)
+	}
+	if _, err := os.Stat(negativePath("r", "missing.jar")); !os.IsNotExist(err) {
+		t.Errorf("Expired entry not removed by gcNegative: %v", err)
+	}
+}
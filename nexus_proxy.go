@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,12 +20,46 @@ import (
 const bufferSize = 65536
 
 type Repo struct {
-	upstreamURLBase        string
-	gcMaxAge               time.Duration
+	// Upstream URLs (mirrors), in order of preference.
+	upstreams []*upstream
+	gcMaxAge  time.Duration
+	// Maximum size of files in final/, see evict.go. 0 for no limit.
+	cacheQuota int64
+	// Size of files in final/, approximately.
+	cacheBytes atomic.Int64
+	// When cached files were last served, see access.go.
+	access *accessIndex
+	// Files listed upstream by prefetcher, see listing.go. nil if not used.
+	listing          *upstreamListing
+	gcKeepListed     bool
+	gcDeleteUnlisted time.Duration
+
 	prefetchType           string
 	prefetchBase           string
 	prefetchIncludeRegexps []*regexp.Regexp
 	prefetchExcludeRegexps []*regexp.Regexp
+	mutableRules           []mutableRule
+	cachePolicies          []cachePolicy
+	offline                bool
+	negativeTTL            time.Duration
+	auth                   *upstreamAuth
+	// Allowlists of headers to forward, see headers.go.
+	forwardRequestHeaders  []string
+	forwardResponseHeaders []string
+	addForwardedHeaders    bool
+	redirectPolicy         RedirectPolicy
+	// Client for all requests to upstream.
+	client *http.Client
+	// Proxy selection used by client.
+	proxy func(*http.Request) (*url.URL, error)
+
+	// In-progress upstream fetches, by filename.
+	fetchesMu sync.Mutex
+	fetches   map[string]*fetch
+	// Held for reading while creating directories in final/ or meta/ and
+	// putting files in them, and for writing while removing empty ones, see
+	// cleanup.go.
+	dirMu sync.RWMutex
 }
 
 func main() {
@@ -36,11 +75,47 @@ func main2() int {
 	prefetchIncludeREs := make(PrefetchREs)
 	prefetchExcludeREs := make(PrefetchREs)
 	gcMaxAges := make(GCMaxAges)
-	flag.Var(&upstreamURLs, "upstream_url", "(repeated) repo definitions. Example: --upstream_url=mynexus=https://nexus.example.com/repository/bin42")
+	cacheQuotas := make(RepoSizes)
+	gcKeepListed := make(RepoBools)
+	gcDeleteUnlisted := make(RepoDurations)
+	mutableRules := make(MutableRules)
+	cachePolicies := make(CachePolicies)
+	offlineRepos := make(RepoBools)
+	negativeTTLs := make(RepoDurations)
+	upstreamAuths := make(RepoStrings)
+	upstreamTLSOptions := make(UpstreamTLSOptions)
+	upstreamClientOptions := make(UpstreamClientOptions)
+	circuitBreakerOptions := make(CircuitBreakerOptions)
+	upstreamProxies := make(UpstreamProxies)
+	upstreamNoProxies := make(RepoStrings)
+	upstreamProxyAuths := make(RepoStrings)
+	forwardRequestHeaders := make(HeaderLists)
+	forwardResponseHeaders := make(HeaderLists)
+	addForwardedHeaders := make(RepoBools)
+	redirectPolicies := make(RedirectPolicies)
+	flag.Var(&upstreamURLs, "upstream_url", "(repeated) repo definitions. Repeat for the same repo to add mirrors, tried in order, with failover on connection errors and 5xx responses. Example: --upstream_url=mynexus=https://nexus.example.com/repository/bin42")
 	flag.Var(&prefetchSpecs, "prefetch", "(repeated) prefetch repo definitions, in form of reponame=prefetchType=prefetchDetails. Example: --prefetch=mynexus=nexus=https://nexus.example.com/service/rest/v1/assets?repository=maven-central")
 	flag.Var(&prefetchIncludeREs, "prefetch_include", "(repeated) prefetch repo include definitions, regular expression. Each repo can use multiple regexpes. If any matches, file is included. Example: --prefetch_include=mynexus=.*.(abc|fgh)\\..+")
 	flag.Var(&prefetchExcludeREs, "prefetch_exclude", "(repeated) prefetch repo exclude definitions, regular expression. Each repo can use multiple regexpes. If any matches, file is excluded. Example: --prefetch_exclude=mynexus=old_.*")
 	flag.Var(&gcMaxAges, "gc_max_age", "(repeated) remove (garbage collect) files older than this time. Can use units, similar to golang time.ParseDuration. Example: --gc_max_age=mynexus=12h")
+	flag.Var(&gcKeepListed, "gc_keep_listed", "(repeated) do not remove (garbage collect) files, which are still listed upstream by the prefetcher (Nexus assets listing, or generic crawl), regardless of their age. Requires --prefetch. Example: --gc_keep_listed=mynexus=true")
+	flag.Var(&gcDeleteUnlisted, "gc_delete_unlisted", "(repeated) remove files, which are no longer listed upstream by the prefetcher for this long (deleted upstream). Requires --prefetch. Example: --gc_delete_unlisted=mynexus=72h")
+	flag.Var(&cachePolicies, "cache_policy", "(repeated) caching and gc policy for files matching regular expression, as comma separated options, then : and the regular expression. max_age=DURATION remove files not used for this long (instead of --gc_max_age), min_age=DURATION never remove (or evict) files cached less than this long ago, cache=false never cache (only stream to clients), pin=true never remove (or evict), min_size=SIZE and max_size=SIZE cache only files with size in this range. First matching policy is used. Example: --cache_policy=mynexus=max_age=1h,max_size=64K:.*/maven-metadata\\.xml$ --cache_policy=mynexus=pin=true:^releases/")
+	flag.Var(&cacheQuotas, "cache_quota", "(repeated) maximum size of files in the cache of the repo, with optional K, M, G or T suffix. When exceeded, least recently used files are evicted, see --quota_high_watermark and --quota_low_watermark. Example: --cache_quota=mynexus=200G")
+	flag.Var(&mutableRules, "mutable", "(repeated) files that can change upstream, as regular expression, and for how long cached copy is fresh. After that, cache hit checks with upstream if the file changed. First matching rule is used. Files not matching any rule never change. Example: --mutable=mynexus=.*/maven-metadata\\.xml$=5m")
+	flag.Var(&offlineRepos, "offline", "(repeated) offline mode. Never contact upstream, only serve files from the cache (even if stale), and respond with 404 to cache misses. Prefetch is disabled. Example: --offline=mynexus=true")
+	flag.Var(&negativeTTLs, "negative_ttl", "(repeated) cache upstream 404 and 410 responses for this long, so repeated requests for missing files do not go to upstream. Disabled by default. Example: --negative_ttl=mynexus=10m")
+	flag.Var(&upstreamAuths, "upstream_auth", "(repeated) credentials for upstream requests (cache fills and prefetch listing), loaded from a file or environment variable, never from the command line. Content is a line with 'basic USER:PASSWORD', 'bearer TOKEN' or 'nexus-token NAME_CODE:PASS_CODE', and/or lines with 'header NAME: VALUE'. Example: --upstream_auth=mynexus=file:/etc/nexus_proxy/mynexus.auth or --upstream_auth=mynexus=env:MYNEXUS_AUTH")
+	flag.Var(&upstreamTLSOptions, "upstream_tls", "(repeated) TLS options for upstream requests, comma separated. ca=PATH custom CA bundle (PEM, replaces system roots), cert=PATH and key=PATH client certificate and key (PEM) for mTLS, min_version=1.2 minimum TLS version (default 1.2), server_name=HOST SNI and name to verify certificate against, pin=sha256//BASE64 (can be repeated) require one of certificates to have public key with this SHA-256 hash. server_name and pin apply only to the host of the first --upstream_url of the repo. Example: --upstream_tls=mynexus=ca=/etc/nexus_proxy/ca.pem,cert=/etc/nexus_proxy/client.pem,key=/etc/nexus_proxy/client.key")
+	flag.Var(&upstreamClientOptions, "upstream_client", "(repeated) upstream client options, comma separated. connect_timeout=10s, tls_timeout=10s TLS handshake timeout, header_timeout=60s time to wait for response headers, idle_timeout=60s abort download if no data received for this long, max_conns=0 maximum connections per upstream host (0 unlimited), retries=2 retries of failed requests (at most 10), before sending anything to a client, retry_backoff=500ms initial backoff between retries, doubled after each retry, up to max_backoff=30s. Values shown are defaults. Example: --upstream_client=mynexus=header_timeout=5m,retries=5")
+	flag.Var(&circuitBreakerOptions, "circuit_breaker", "(repeated) enable circuit breaker for each upstream URL of the repo, with comma separated options. error_rate=0.5 open when this fraction of requests fail, min_requests=10 minimum number of requests in the window, window=1m, open_for=30s how long to not send any requests, before trying one again. While open, cache misses fail with 503, and prefetch is skipped. Values shown are defaults. Example: --circuit_breaker=mynexus=error_rate=0.2,open_for=1m")
+	flag.Var(&upstreamProxies, "upstream_proxy", "(repeated) connect to upstream via this proxy (http, https, socks5 or socks5h). By default HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used. Example: --upstream_proxy=mynexus=http://egress.example.com:3128")
+	flag.Var(&upstreamNoProxies, "upstream_no_proxy", "(repeated) comma separated list of hosts to connect to directly, not via --upstream_proxy. Domains (also matching subdomains), IP addresses, networks in CIDR notation, each optionally with :PORT, or * for all. Example: --upstream_no_proxy=mynexus=.internal.example.com,10.0.0.0/8")
+	flag.Var(&upstreamProxyAuths, "upstream_proxy_auth", "(repeated) credentials for --upstream_proxy, as USER:PASSWORD, loaded from a file or environment variable. Example: --upstream_proxy_auth=mynexus=env:EGRESS_PROXY_AUTH")
+	flag.Var(&forwardRequestHeaders, "forward_request_headers", "(repeated) comma separated list of client request headers to forward to upstream. Requests selecting different variants (see Vary) do not share upstream download. Example: --forward_request_headers=mynexus=Accept,User-Agent")
+	flag.Var(&forwardResponseHeaders, "forward_response_headers", "(repeated) comma separated list of upstream response headers to send to clients, in addition to Content-Type and Content-Disposition. They are stored in the cache metadata, and also sent on cache hits. Example: --forward_response_headers=mynexus=Content-Encoding,X-Checksum-Sha1")
+	flag.Var(&addForwardedHeaders, "add_forwarded_headers", "(repeated) add X-Forwarded-For, Forwarded and Via headers to upstream requests. Example: --add_forwarded_headers=mynexus=true")
+	flag.Var(&redirectPolicies, "upstream_redirects", "(repeated) how to handle upstream redirects, comma separated options. max_hops=10 maximum number of redirects to follow, allow_host=HOST (can be repeated) follow redirects to other hosts only if listed (.example.com matches subdomains), by default any host is allowed, forward_auth=false send --upstream_auth credentials to other hosts, mode=follow follow redirects, caching the final content under the requested path, or mode=relay send redirects to clients, without caching. Values shown are defaults. Example: --upstream_redirects=mynexus=allow_host=.blob.core.windows.net,max_hops=3")
 	flag.Parse()
 	if flag.NFlag() == 0 {
 		flag.PrintDefaults()
@@ -59,10 +134,14 @@ func main2() int {
 	log.Printf("prefetchExcludeREs: %#v", prefetchExcludeREs)
 
 	repos := make(map[string]*Repo)
-	for reponame, upstreamURLBase := range upstreamURLs {
-		repos[reponame] = &Repo{
-			upstreamURLBase: upstreamURLBase,
+	for reponame, upstreamURLBases := range upstreamURLs {
+		repo := &Repo{
+			fetches: make(map[string]*fetch),
 		}
+		for _, upstreamURLBase := range upstreamURLBases {
+			repo.upstreams = append(repo.upstreams, newUpstream(reponame, upstreamURLBase))
+		}
+		repos[reponame] = repo
 	}
 	for reponame, prefetchSpec := range prefetchSpecs {
 		repo, exists := repos[reponame]
@@ -103,6 +182,203 @@ func main2() int {
 		}
 		repo.gcMaxAge = maxAge
 	}
+	for reponame, keep := range gcKeepListed {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --gc_keep_listed is not defined by any --upstream_url argument", reponame)
+		}
+		if len(repo.prefetchBase) == 0 {
+			log.Fatalf("Repo name %q referenced in --gc_keep_listed has no --prefetch argument", reponame)
+		}
+		repo.gcKeepListed = keep
+	}
+	for reponame, grace := range gcDeleteUnlisted {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --gc_delete_unlisted is not defined by any --upstream_url argument", reponame)
+		}
+		if len(repo.prefetchBase) == 0 {
+			log.Fatalf("Repo name %q referenced in --gc_delete_unlisted has no --prefetch argument", reponame)
+		}
+		repo.gcDeleteUnlisted = grace
+	}
+	for reponame, quota := range cacheQuotas {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --cache_quota is not defined by any --upstream_url argument", reponame)
+		}
+		repo.cacheQuota = quota
+	}
+	if !(0 < *quotaLowWatermark && *quotaLowWatermark < *quotaHighWatermark && *quotaHighWatermark <= 1) {
+		log.Fatalf("Watermarks must satisfy 0 < --quota_low_watermark < --quota_high_watermark <= 1")
+	}
+
+	for reponame, rules := range mutableRules {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --mutable is not defined by any --upstream_url argument", reponame)
+		}
+		for _, rule := range rules {
+			repo.mutableRules = append(repo.mutableRules, mutableRule{
+				re:     regexp.MustCompile(rule.Regexp),
+				maxAge: rule.MaxAge,
+			})
+		}
+	}
+
+	for reponame, policies := range cachePolicies {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --cache_policy is not defined by any --upstream_url argument", reponame)
+		}
+		for _, policy := range policies {
+			repo.cachePolicies = append(repo.cachePolicies, cachePolicy{
+				re:      regexp.MustCompile(policy.Regexp),
+				maxAge:  policy.MaxAge,
+				minAge:  policy.MinAge,
+				noCache: policy.NoCache,
+				pin:     policy.Pin,
+				minSize: policy.MinSize,
+				maxSize: policy.MaxSize,
+			})
+		}
+	}
+
+	for reponame, offline := range offlineRepos {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --offline is not defined by any --upstream_url argument", reponame)
+		}
+		repo.offline = offline
+	}
+
+	for reponame, names := range forwardRequestHeaders {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --forward_request_headers is not defined by any --upstream_url argument", reponame)
+		}
+		repo.forwardRequestHeaders = names
+	}
+	for reponame, names := range forwardResponseHeaders {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --forward_response_headers is not defined by any --upstream_url argument", reponame)
+		}
+		repo.forwardResponseHeaders = names
+	}
+	for reponame, add := range addForwardedHeaders {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --add_forwarded_headers is not defined by any --upstream_url argument", reponame)
+		}
+		repo.addForwardedHeaders = add
+	}
+
+	for reponame, negativeTTL := range negativeTTLs {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --negative_ttl is not defined by any --upstream_url argument", reponame)
+		}
+		repo.negativeTTL = negativeTTL
+	}
+
+	for reponame, source := range upstreamAuths {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_auth is not defined by any --upstream_url argument", reponame)
+		}
+		auth, err := loadUpstreamAuth(source)
+		if err != nil {
+			log.Fatalf("Failed to load credentials for repo %q from %q. Error: %v", reponame, source, err)
+		}
+		repo.auth = auth
+	}
+
+	for reponame := range upstreamTLSOptions {
+		if _, exists := repos[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_tls is not defined by any --upstream_url argument", reponame)
+		}
+	}
+	for reponame, option := range circuitBreakerOptions {
+		repo, exists := repos[reponame]
+		if !exists {
+			log.Fatalf("Repo name %q referenced in --circuit_breaker is not defined by any --upstream_url argument", reponame)
+		}
+		for _, u := range repo.upstreams {
+			u.breaker = newCircuitBreaker(option, reponame, u.base)
+		}
+	}
+	proxies := make(map[string]func(*http.Request) (*url.URL, error))
+	for reponame, proxyURL := range upstreamProxies {
+		if _, exists := repos[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_proxy is not defined by any --upstream_url argument", reponame)
+		}
+		if source, exists := upstreamProxyAuths[reponame]; exists {
+			credentials, err := loadSecret(source)
+			if err != nil {
+				log.Fatalf("Failed to load proxy credentials for repo %q from %q. Error: %v", reponame, source, err)
+			}
+			username, password, good := strings.Cut(strings.TrimSpace(credentials), ":")
+			if !good {
+				log.Fatalf("Proxy credentials for repo %q from %q must be in form of USER:PASSWORD", reponame, source)
+			}
+			proxyURL.User = url.UserPassword(username, password)
+		}
+		noProxy, err := parseNoProxy(upstreamNoProxies[reponame])
+		if err != nil {
+			log.Fatalf("Failed to parse --upstream_no_proxy for repo %q. Error: %v", reponame, err)
+		}
+		proxies[reponame] = newUpstreamProxy(proxyURL, noProxy)
+	}
+	for reponame := range upstreamNoProxies {
+		if _, exists := upstreamProxies[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_no_proxy has no --upstream_proxy argument", reponame)
+		}
+	}
+	for reponame := range upstreamProxyAuths {
+		if _, exists := upstreamProxies[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_proxy_auth has no --upstream_proxy argument", reponame)
+		}
+	}
+	for reponame := range redirectPolicies {
+		if _, exists := repos[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_redirects is not defined by any --upstream_url argument", reponame)
+		}
+	}
+	for reponame := range upstreamClientOptions {
+		if _, exists := repos[reponame]; !exists {
+			log.Fatalf("Repo name %q referenced in --upstream_client is not defined by any --upstream_url argument", reponame)
+		}
+	}
+	for reponame, repo := range repos {
+		var tlsConfig *tls.Config
+		if option, exists := upstreamTLSOptions[reponame]; exists {
+			var err error
+			tlsConfig, err = newUpstreamTLSConfig(option)
+			if err != nil {
+				log.Fatalf("Failed to setup TLS for repo %q. Error: %v", reponame, err)
+			}
+		}
+		clientOption, exists := upstreamClientOptions[reponame]
+		if !exists {
+			clientOption = defaultUpstreamClientOption()
+		}
+		repo.proxy = proxies[reponame]
+		if repo.proxy == nil {
+			repo.proxy = http.ProxyFromEnvironment
+		}
+		// Server name and pins are for the first upstream URL only.
+		primary, err := url.Parse(repo.upstreams[0].base)
+		if err != nil {
+			log.Fatalf("Failed to parse upstream URL of repo %q. Error: %v", reponame, err)
+		}
+		repo.client = newUpstreamClient(clientOption, tlsConfig, tlsHost(primary), repo.proxy)
+		repo.redirectPolicy, exists = redirectPolicies[reponame]
+		if !exists {
+			repo.redirectPolicy = defaultRedirectPolicy()
+		}
+		repo.client.CheckRedirect = repo.checkRedirect
+	}
 
 	for reponame, repo := range repos {
 		log.Printf("repo %q: %#v", reponame, repo)
@@ -126,15 +402,51 @@ func main2() int {
 		if err != nil && !os.IsExist(err) {
 			log.Fatal(err)
 		}
+		err = os.MkdirAll("cache/"+reponame+"/negative", os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			log.Fatal(err)
+		}
+		err = os.MkdirAll("cache/"+reponame+"/access", os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			log.Fatal(err)
+		}
+	}
+	for reponame, repo := range repos {
+		repo.access, err = loadAccessIndex(reponame)
+		if err != nil {
+			// Use what was read, other files fall back to file system times.
+			error_count.Inc()
+			log.Printf("Failed to load access index of repo %q. Error: %v", reponame, err)
+		}
+		log.Printf("Loaded access index of repo %q, %d files", reponame, repo.access.size())
+		if repo.gcKeepListed || repo.gcDeleteUnlisted > 0 {
+			err = os.MkdirAll("cache/"+reponame+"/listing", os.ModePerm)
+			if err != nil && !os.IsExist(err) {
+				log.Fatal(err)
+			}
+			repo.listing, err = loadUpstreamListing(reponame, repo.prefetchType == "nexus")
+			if err != nil {
+				// Next complete listing will fix it.
+				error_count.Inc()
+				log.Printf("Failed to load upstream listing of repo %q. Error: %v", reponame, err)
+			}
+			log.Printf("Loaded upstream listing of repo %q, %d files", reponame, repo.listing.size())
+		}
 	}
 
 	update_free_disk_space()
 
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/proxy/", proxyHandler(repos))
+	http.HandleFunc("/status", statusHandler(repos))
+	http.HandleFunc("/ready", readyHandler(repos))
 
 	prefetchStopChan := startPrefetchLoop(repos)
 	gcStopChan := startGCLoop(repos)
+	healthCheckStopChan := startHealthCheckLoop(repos, *healthCheckInterval)
+	resolveStopChan := startResolveLoop(repos, *resolveInterval)
+	accessIndexStopChan := startAccessIndexLoop(repos, *accessIndexInterval)
+	cleanupStopChan := startCleanupLoop(repos, *cleanupInterval)
 
 	listenSpec := ":" + strconv.Itoa(*listenPort)
 	log.Printf("Starting listening on %q\n", listenSpec)
@@ -142,6 +454,10 @@ func main2() int {
 
 	prefetchStopChan <- true
 	gcStopChan <- true
+	healthCheckStopChan <- true
+	resolveStopChan <- true
+	accessIndexStopChan <- true
+	cleanupStopChan <- true
 
 	return 0
 }
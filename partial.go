@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Progress record of partially downloaded file. Kept in cache/REPO/temp/,
+// next to the partial data, so the download can be resumed later using
+// ranged upstream request.
+type partialProgress struct {
+	Filename     string    `json:"filename"`
+	URL          string    `json:"url"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Written      int64     `json:"written"`
+	Updated      time.Time `json:"updated"`
+}
+
+// partialPaths returns paths of partial data file and its progress record.
+// Filename is hashed, so there is no need to create subdirectories in temp/,
+// and there are no issues with very long file names.
+func partialPaths(reponame, filename string) (dataPath, progressPath string) {
+	sum := sha256.Sum256([]byte(filename))
+	base := "cache/" + reponame + "/temp/" + hex.EncodeToString(sum[:]) + ".partial"
+	return base, base + ".json"
+}
+
+// loadPartial opens previously saved partial download of a file for resuming.
+//
+// Returns nil TempFile if there is no usable partial download. This includes
+// the case of the partial file being resumed by other process right now.
+// On success returned TempFile is positioned at the end of data.
+func loadPartial(reponame, filename, finalPath, upstreamURL string) (*TempFile, *partialProgress, error) {
+	dataPath, progressPath := partialPaths(reponame, filename)
+
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// Lock is released automatically on close, including process crash.
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, nil, nil
+		}
+		return nil, nil, &os.PathError{Op: "flock", Path: dataPath, Err: err}
+	}
+
+	discard := func(reason error) (*TempFile, *partialProgress, error) {
+		os.Remove(progressPath)
+		os.Remove(dataPath)
+		f.Close()
+		return nil, nil, reason
+	}
+
+	progressData, err := os.ReadFile(progressPath)
+	if err != nil {
+		return discard(err)
+	}
+	progress := &partialProgress{}
+	if err := json.Unmarshal(progressData, progress); err != nil {
+		return discard(err)
+	}
+	if progress.Filename != filename || progress.URL != upstreamURL {
+		return discard(errors.New("Partial download progress record is for different file or upstream URL"))
+	}
+	if progress.ETag == "" && progress.LastModified == "" {
+		return discard(errors.New("Partial download progress record has no validators"))
+	}
+	// Written bytes might not have been fully flushed to disk (i.e. crash
+	// of the machine), so only trust the progress record, if file is at
+	// least as big.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return discard(err)
+	}
+	if size < progress.Written || progress.Written <= 0 || progress.Written >= progress.Size {
+		return discard(fmt.Errorf("Partial download has unexpected size %d, expected %d of %d", size, progress.Written, progress.Size))
+	}
+	if size > progress.Written {
+		if err := f.Truncate(progress.Written); err != nil {
+			return discard(err)
+		}
+		if _, err := f.Seek(progress.Written, io.SeekStart); err != nil {
+			return discard(err)
+		}
+	}
+	return &TempFile{
+		temp:      f,
+		finalPath: finalPath,
+	}, progress, nil
+}
+
+// savePartial keeps the data in a temporary file, and progress record, so
+// the download can be resumed later. Closes the temporary file.
+func savePartial(t *TempFile, reponame string, progress *partialProgress) error {
+	dataPath, progressPath := partialPaths(reponame, progress.Filename)
+	if err := t.File().Sync(); err != nil {
+		return err
+	}
+	progress.Updated = time.Now()
+	progressData, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	// Write progress to a temporary file first, so there is never a partial
+	// progress record.
+	err = os.WriteFile(progressPath+".new", progressData, 0600)
+	if err == nil {
+		err = os.Rename(progressPath+".new", progressPath)
+	}
+	if err != nil {
+		os.Remove(progressPath + ".new")
+		return err
+	}
+	if err := t.Persist(dataPath); err != nil {
+		os.Remove(progressPath)
+		return err
+	}
+	return nil
+}
+
+func removePartialProgress(reponame, filename string) {
+	_, progressPath := partialPaths(reponame, filename)
+	os.Remove(progressPath)
+}
+
+// parseContentRange parses Content-Range header of a 206 response with a
+// single range, returning start of the range, and total size of the file.
+func parseContentRange(resp *http.Response) (start, total int64, ok bool) {
+	var end int64
+	n, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil || n != 3 || start < 0 || end < start || total <= end {
+		return 0, 0, false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != end-start+1 {
+		return 0, 0, false
+	}
+	return start, total, true
+}
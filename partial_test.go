@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		contentRange  string
+		contentLength int64
+		start, total  int64
+		ok            bool
+	}{
+		{"bytes 0-99/100", 100, 0, 100, true},
+		{"bytes 40-99/100", 60, 40, 100, true},
+		{"bytes 40-99/100", -1, 40, 100, true},
+		{"bytes 40-99/100", 50, 0, 0, false},
+		{"bytes 40-100/100", 61, 0, 0, false},
+		{"bytes 50-40/100", -1, 0, 0, false},
+		{"bytes 40-99/*", -1, 0, 0, false},
+		{"bytes */100", -1, 0, 0, false},
+		{"", -1, 0, 0, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{
+			Header:        http.Header{"Content-Range": {test.contentRange}},
+			ContentLength: test.contentLength,
+		}
+		start, total, ok := parseContentRange(resp)
+		if start != test.start || total != test.total || ok != test.ok {
+			t.Errorf("parseContentRange(%q, length %d) = %d, %d, %v, want %d, %d, %v", test.contentRange, test.contentLength, start, total, ok, test.start, test.total, test.ok)
+		}
+	}
+}
+
+func TestPartialDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	const failAfter = 400
+	var mu sync.Mutex
+	var ranges []string
+	var requests atomic.Int32
+	repo, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			mu.Lock()
+			ranges = append(ranges, rangeHeader+" "+r.Header.Get("If-Range"))
+			mu.Unlock()
+			var start int
+			fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[start:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if n > 1 {
+			w.Write(content)
+			return
+		}
+		w.Write(content[:failAfter])
+		w.(http.Flusher).Flush()
+		// Upstream connection reset.
+		panic(http.ErrAbortHandler)
+	}))
+
+	resp, err := http.Get(proxy.URL + "/proxy/r/big.bin")
+	if err == nil {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	waitFetches(t, repo)
+	dataPath, progressPath := partialPaths("r", "big.bin")
+	if fi, err := os.Stat(dataPath); err != nil || fi.Size() != failAfter {
+		t.Fatalf("Partial download not kept: %v %v", fi, err)
+	}
+	if _, err := os.Stat(progressPath); err != nil {
+		t.Fatalf("Partial download progress not kept: %v", err)
+	}
+	if _, err := os.Stat("cache/r/final/big.bin"); err == nil {
+		t.Fatalf("Partial download moved to final/")
+	}
+
+	resp, err = http.Get(proxy.URL + "/proxy/r/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, content) {
+		t.Fatalf("Resumed download got %d bytes (error %v), want %d", len(body), err, len(content))
+	}
+	waitFetches(t, repo)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf(`bytes=%d- "v1"`, failAfter) {
+		t.Errorf("Upstream ranged requests %q, want one from %d with If-Range", ranges, failAfter)
+	}
+	cached, err := os.ReadFile("cache/r/final/big.bin")
+	if err != nil || !bytes.Equal(cached, content) {
+		t.Errorf("Cached file has %d bytes (error %v), want %d", len(cached), err, len(content))
+	}
+	if _, err := os.Stat(dataPath); err == nil {
+		t.Errorf("Partial download not removed after resume")
+	}
+	if _, err := os.Stat(progressPath); err == nil {
+		t.Errorf("Partial download progress not removed after resume")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+// cachePolicy overrides caching and garbage collection of files matching
+// regexp (i.e. keep release artifacts for years, but remove small metadata
+// files soon). First matching policy of the repo is used.
+type cachePolicy struct {
+	re *regexp.Regexp
+	// Remove files not used for this long, instead of --gc_max_age.
+	maxAge time.Duration
+	// Do not remove (or evict) files put in the cache less than this long ago.
+	minAge time.Duration
+	// Never cache, only stream to clients. Not prefetched.
+	noCache bool
+	// Never remove (or evict).
+	pin bool
+	// Cache only files with size in this range. 0 for no limit.
+	minSize int64
+	maxSize int64
+}
+
+// cachePolicy returns policy of the file, or nil if no policy matches.
+// Variants are matched by the name of the file, see vary.go.
+func (repo *Repo) cachePolicy(filename string) *cachePolicy {
+	filename = variantOf(filename)
+	for i := range repo.cachePolicies {
+		if repo.cachePolicies[i].re.MatchString(filename) {
+			return &repo.cachePolicies[i]
+		}
+	}
+	return nil
+}
+
+// allowsCaching checks if the file of the given size can be cached. Size is
+// -1 if not known (yet).
+func (policy *cachePolicy) allowsCaching(size int64) bool {
+	if policy == nil {
+		return true
+	}
+	if policy.noCache {
+		return false
+	}
+	if size < 0 {
+		return true
+	}
+	return size >= policy.minSize && (policy.maxSize == 0 || size <= policy.maxSize)
+}
+
+// gcMaxAge returns for how long unused file is kept, 0 for forever.
+func (policy *cachePolicy) gcMaxAge(repo *Repo) time.Duration {
+	if policy == nil {
+		return repo.gcMaxAge
+	}
+	if policy.pin {
+		return 0
+	}
+	if policy.maxAge > 0 {
+		return policy.maxAge
+	}
+	return repo.gcMaxAge
+}
+
+// canRemove checks if the file put in the cache at cachedTime can be removed
+// by GC or eviction.
+func (policy *cachePolicy) canRemove(cachedTime time.Time) bool {
+	if policy == nil {
+		return true
+	}
+	return !policy.pin && time.Since(cachedTime) >= policy.minAge
+}
+
+// hasGC returns true if any files of the repo can be garbage collected.
+func (repo *Repo) hasGC() bool {
+	if repo.gcMaxAge > 0 || repo.gcDeleteUnlisted > 0 {
+		return true
+	}
+	for _, policy := range repo.cachePolicies {
+		if policy.maxAge > 0 && !policy.pin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCachePolicy(t *testing.T) {
+	repo := &Repo{
+		gcMaxAge: 24 * time.Hour,
+		cachePolicies: []cachePolicy{
+			{re: regexp.MustCompile(`\.pom$`), maxAge: time.Hour, minAge: time.Minute},
+			{re: regexp.MustCompile(`^releases/`), pin: true},
+			{re: regexp.MustCompile(`^tmp/`), noCache: true},
+			{re: regexp.MustCompile(`\.iso$`), minSize: 10, maxSize: 100},
+		},
+	}
+
+	// First matching policy is used, variants by the name of the file.
+	if policy := repo.cachePolicy("releases/a.pom"); policy != &repo.cachePolicies[0] {
+		t.Errorf("cachePolicy(\"releases/a.pom\") = %v, want first policy", policy)
+	}
+	if policy := repo.cachePolicy("releases/a.jar"); policy != &repo.cachePolicies[1] {
+		t.Errorf("cachePolicy(\"releases/a.jar\") = %v, want second policy", policy)
+	}
+	if policy := repo.cachePolicy("a.pom" + varyDirSuffix + "/0123"); policy != &repo.cachePolicies[0] {
+		t.Errorf("cachePolicy() of a variant = %v, want first policy", policy)
+	}
+	if policy := repo.cachePolicy("a.jar"); policy != nil {
+		t.Errorf("cachePolicy(\"a.jar\") = %v, want nil", policy)
+	}
+
+	cachingTests := []struct {
+		filename string
+		size     int64
+		want     bool
+	}{
+		{"a.jar", 1 << 30, true},
+		{"tmp/a.jar", -1, false},
+		{"a.iso", -1, true},
+		{"a.iso", 9, false},
+		{"a.iso", 10, true},
+		{"a.iso", 100, true},
+		{"a.iso", 101, false},
+	}
+	for _, test := range cachingTests {
+		if got := repo.cachePolicy(test.filename).allowsCaching(test.size); got != test.want {
+			t.Errorf("allowsCaching(%q, %d) = %v, want %v", test.filename, test.size, got, test.want)
+		}
+	}
+
+	gcTests := []struct {
+		filename string
+		want     time.Duration
+	}{
+		{"a.jar", 24 * time.Hour},
+		{"a.pom", time.Hour},
+		{"releases/a.jar", 0},
+		{"a.iso", 24 * time.Hour},
+	}
+	for _, test := range gcTests {
+		if got := repo.cachePolicy(test.filename).gcMaxAge(repo); got != test.want {
+			t.Errorf("gcMaxAge(%q) = %s, want %s", test.filename, got, test.want)
+		}
+	}
+
+	removeTests := []struct {
+		filename string
+		age      time.Duration
+		want     bool
+	}{
+		{"a.jar", 0, true},
+		{"a.pom", time.Second, false},
+		{"a.pom", time.Hour, true},
+		{"releases/a.jar", 1000 * time.Hour, false},
+	}
+	for _, test := range removeTests {
+		if got := repo.cachePolicy(test.filename).canRemove(time.Now().Add(-test.age)); got != test.want {
+			t.Errorf("canRemove(%q, cached %s ago) = %v, want %v", test.filename, test.age, got, test.want)
+		}
+	}
+
+	if !repo.hasGC() {
+		t.Errorf("hasGC() = false with --gc_max_age")
+	}
+	repo.gcMaxAge = 0
+	if !repo.hasGC() {
+		t.Errorf("hasGC() = false with policy max_age")
+	}
+	repo.cachePolicies = repo.cachePolicies[1:]
+	if repo.hasGC() {
+		t.Errorf("hasGC() = true without any max age")
+	}
+}
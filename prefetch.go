@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -24,6 +24,8 @@ type NexusItem struct {
 	Repository  string            `json:"repository"`
 	Format      string            `json:"format"`
 	Checksums   map[string]string `json:"checksum"`
+	// Not reported by older Nexus versions.
+	FileSize int64 `json:"fileSize"`
 }
 
 type NexusAssetsResponse struct {
@@ -76,37 +78,59 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 			return nil
 		}
 
+		size := item.FileSize
+		if size == 0 {
+			size = -1
+		}
+		if !repo.cachePolicy(filename).allowsCaching(size) {
+			prefetch_ignore_count.Inc()
+			return nil
+		}
+
 		// log.Printf("prefetcher: Processing %#v", item)
 
 		cacheFilename := "cache/" + reponame + "/final/" + filename
-		if _, err := os.Stat(cacheFilename); !errors.Is(err, os.ErrNotExist) {
+		cache, _, err := openCached(reponame, filename, nil)
+		if err == nil {
+			cache.Close()
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			prefetch_skip_count.Inc()
+			return nil
+		}
+
+		if repo.lookupNegative(reponame, filename) != 0 {
 			prefetch_skip_count.Inc()
 			return nil
 		}
 
 		log.Printf("prefetcher: Prefetching missing %#v", item)
 
-		resp, err := http.Get(repo.upstreamURLBase + filename)
+		// Share the download with any concurrent cache miss of the same file.
+		f, started, err := repo.startFetch(reponame, filename, cacheFilename, false, nil, nil)
 		if err != nil {
 			return err
 		}
-		defer resp.Body.Close()
-
-		cacheTemp, err := NewTempFile("cache/"+reponame+"/temp/", filename, cacheFilename)
-		if err != nil {
+		if f == nil {
+			// Fetched by a cache miss in the meantime.
+			prefetch_skip_count.Inc()
+			return nil
+		}
+		defer f.release()
+		err = f.wait()
+		if !started {
+			prefetch_skip_count.Inc()
 			return err
 		}
-		bytesCopiedCount, err := io.Copy(cacheTemp.File(), resp.Body)
-		prefetch_download_bytes.Add(float64(bytesCopiedCount))
+		prefetch_download_bytes.Add(float64(f.written))
 		if err != nil {
-			cacheTemp.Cleanup()
 			return err
-		} else {
-			err = cacheTemp.Finalize()
-			prefetch_download_count.Inc()
 		}
-		update_free_disk_space()
-		return err
+		if f.statusCode != 200 {
+			return fmt.Errorf("Upstream responded with status %d", f.statusCode)
+		}
+		prefetch_download_count.Inc()
+		return nil
 	}
 
 	updater := func(reponame string, repo *Repo) {
@@ -119,10 +143,30 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 			log.Printf("prefetcher: Skipping update loop for repo %q", reponame)
 			return
 		}
+		if repo.offline {
+			log.Printf("prefetcher: Skipping update loop for repo %q in offline mode", reponame)
+			return
+		}
+
+		if repo.circuitOpen() {
+			log.Printf("prefetcher: Skipping update loop for repo %q, circuit breaker open", reponame)
+			return
+		}
 
 		log.Printf("prefetcher: Update loop started")
 		t1 := time.Now()
 
+		// Record what is listed upstream for GC, see listing.go.
+		listingID := repo.listing.start()
+		listingComplete := false
+		defer func() {
+			if err := repo.listing.finish(listingID, listingComplete, repo.gcDeleteUnlisted); err != nil {
+				error_count.Inc()
+				log.Printf("prefetcher: Failed to save upstream listing of repo %q. Error: %v", reponame, err)
+			}
+			upstream_listed_files.WithLabelValues(reponame).Set(float64(repo.listing.size()))
+		}()
+
 		update_free_disk_space()
 
 		timer := prometheus.NewTimer(prefetch_loop_time)
@@ -134,7 +178,9 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 		}()
 
 		nexusClient := http.Client{
-			Timeout: 30 * time.Second,
+			Transport:     repo.client.Transport,
+			CheckRedirect: repo.followRedirect,
+			Timeout:       30 * time.Second,
 		}
 
 		// https://help.sonatype.com/repomanager3/integrations/rest-and-integration-api/assets-api#AssetsAPI-ListAssets
@@ -219,32 +265,39 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 		skippedDirs := 0
 
 		if repo.prefetchType == "generic" {
+			// Crawl is complete only if all directories were listed.
+			crawlComplete := true
 			var recursor func(url string, depth int) error
 			recursor = func(url string, depth int) error {
 				totalFetches++
 				if totalFetches > recursionLimit {
+					crawlComplete = false
 					return errors.New("Not recursing futher, as already reached 1000 requests")
 				}
 
 				time.Sleep(10 * time.Millisecond)
-				req, err := http.NewRequest(http.MethodGet, url, nil)
+				req, err := repo.newUpstreamRequest(http.MethodGet, url)
 				if err != nil {
+					crawlComplete = false
 					prefetch_list_error_count.Inc()
 					return err
 				}
 				req.Header.Set("User-Agent", "nexus-proxy")
 				resp, err := nexusClient.Do(req)
 				if err != nil {
+					crawlComplete = false
 					prefetch_list_error_count.Inc()
 					log.Printf("prefetcher: Cannot make a request. Error: %v", err)
 					return err
 				}
 				defer resp.Body.Close()
 				if resp.StatusCode != 200 {
+					crawlComplete = false
 					prefetch_list_error_count.Inc()
 					log.Printf("prefetcher: Error response. Status: %d", resp.StatusCode)
 					return nil // TODO
 				}
+				dir, dirOnUpstream := repo.crawledFilename(url)
 
 				scanner := bufio.NewScanner(resp.Body)
 
@@ -270,6 +323,9 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 						if strings.Contains(href, "&") {
 							continue
 						}
+						if filename, ok := repo.crawledFilename(url + href); ok && !strings.HasSuffix(href, "/") {
+							repo.listing.add(listingID, filename)
+						}
 						if !matcher(repo, href) {
 							if strings.HasSuffix(href, "/") {
 								skippedDirs++
@@ -302,12 +358,16 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 					}
 				}
 				if err = scanner.Err(); err != nil {
+					crawlComplete = false
 					log.Printf("prefetcher: Read error %v:", err)
+				} else if dirOnUpstream {
+					repo.listing.addDir(listingID, dir)
 				}
 				return err
 			}
 
 			recursor(url, 0)
+			listingComplete = crawlComplete && totalFetches < recursionLimit
 		} else if repo.prefetchType == "nexus" {
 			continuationToken := ""
 			for {
@@ -318,7 +378,7 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 					urlWithContinuation = url
 				}
 				prefetch_list_request_count.Inc()
-				req, err := http.NewRequest(http.MethodGet, urlWithContinuation, nil)
+				req, err := repo.newUpstreamRequest(http.MethodGet, urlWithContinuation)
 				if err != nil {
 					prefetch_list_error_count.Inc()
 					break
@@ -347,9 +407,16 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 				if jsonDecoder.More() {
 					log.Printf("prefetcher: Warning: Found more tokens after first JSON object decoded in Nexus response. Ignoring")
 				}
+				for _, item := range response.Items {
+					repo.listing.add(listingID, item.Path)
+				}
 				if response.Items != nil {
 					for _, item := range response.Items {
 						err = process(reponame, repo, item)
+						if errors.Is(err, errCircuitOpen) {
+							log.Printf("prefetcher: Stopping update loop for repo %q, circuit breaker open", reponame)
+							return
+						}
 						if err != nil {
 							log.Printf("prefetcher: Failed to process item. Error: %v", err)
 							prefetch_download_error_count.Inc()
@@ -359,6 +426,7 @@ func startPrefetchLoop(repos map[string]*Repo) chan bool {
 				if len(response.ContinuationToken) > 0 {
 					continuationToken = response.ContinuationToken
 				} else {
+					listingComplete = true
 					break
 				}
 			}
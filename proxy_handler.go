@@ -1,17 +1,22 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const allowedMethods = "GET, HEAD, OPTIONS"
+
 func isUnsafeFilename(filename string) bool {
-	return strings.HasPrefix(filename, "../") || strings.HasPrefix(filename, "/") || strings.HasSuffix(filename, "/..") || strings.HasSuffix(filename, "/") || strings.Contains(filename, "//") || strings.Contains(filename, "/../") || strings.Contains(filename, "/./") || strings.Contains(filename, "\\")
+	return strings.HasPrefix(filename, "../") || strings.HasPrefix(filename, "/") || strings.HasSuffix(filename, "/..") || strings.HasSuffix(filename, "/") || strings.Contains(filename, "//") || strings.Contains(filename, "/../") || strings.Contains(filename, "/./") || strings.Contains(filename, "\\") || strings.Contains(filename, varyDirSuffix)
 }
 
 func proxyHandler(repos map[string]*Repo) http.HandlerFunc {
@@ -22,11 +27,19 @@ func proxyHandler(repos map[string]*Repo) http.HandlerFunc {
 		}()
 
 		log.Printf("PRE %s   0 %q Request handler started\n", r.RemoteAddr, r.URL.Path)
-		if r.Method != "GET" {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions:
+			w.Header().Set("Allow", allowedMethods)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusNoContent)
+			log.Printf("END %s 204 %q Method %q\n", r.RemoteAddr, r.URL.Path, r.Method)
+			return
+		default:
 			error_count.Inc()
-			w.Header().Set("Allow", "GET")
+			w.Header().Set("Allow", allowedMethods)
 			w.WriteHeader(http.StatusMethodNotAllowed)
-			log.Printf("END %s 405 %q Method %q not allowed\n", r.RemoteAddr, r.Method, r.URL.Path)
+			log.Printf("END %s 405 %q Method %q not allowed\n", r.RemoteAddr, r.URL.Path, r.Method)
 			return
 		}
 
@@ -65,16 +78,56 @@ func proxyHandler(repos map[string]*Repo) http.HandlerFunc {
 			error_count.Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("400 Bad Request\n\nProhobited byte sequence in filename\n"))
-			log.Printf("END %s 400 %q Prohibited byte sequence in filename\n", r.RemoteAddr, path, reponame)
+			log.Printf("END %s 400 %q Prohibited byte sequence in filename\n", r.RemoteAddr, path)
 			return
 		}
 
 		cacheFilename := "cache/" + reponame + "/final/" + filename
-		cache, err := os.Open(cacheFilename)
+		cache, cachedName, err := openCached(reponame, filename, repo.forwardHeaders(r))
 		// Cache hit
 		if err == nil {
 			defer cache.Close()
-			handleHit(w, r, path, cache)
+			// Might be a variant, see vary.go.
+			cacheFilename = "cache/" + reponame + "/final/" + cachedName
+			meta := readHitMeta(r, reponame, path, cachedName, cache)
+			freshness := repo.checkFreshness(filename, meta, cache)
+			if repo.offline {
+				if freshness != cacheFresh {
+					stale_served_count.Inc()
+					w.Header().Set("Warning", `112 - "Disconnected Operation"`)
+				}
+			} else if r.Method == http.MethodGet {
+				switch freshness {
+				case cacheStale:
+					handleRevalidate(w, r, reponame, repo, path, filename, cacheFilename, cache, meta)
+					return
+				case cacheStaleRevalidateInBackground:
+					revalidateInBackground(r, reponame, repo, path, filename, cacheFilename, meta)
+					stale_served_count.Inc()
+					w.Header().Set("Warning", `110 - "Response is Stale"`)
+				}
+			}
+			handleHit(w, r, repo, path, cachedName, cache, meta)
+			return
+		}
+
+		if repo.offline {
+			offline_miss_count.Inc()
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 Not Found\n\nRepo " + reponame + " is in offline mode, and file is not in the cache\n"))
+			log.Printf("END %s 404 %q Cache miss in offline mode\n", r.RemoteAddr, path)
+			return
+		}
+
+		if statusCode := repo.lookupNegative(reponame, filename); statusCode != 0 {
+			negative_hit_count.Inc()
+			w.WriteHeader(statusCode)
+			log.Printf("END %s %d %q Negative cache hit\n", r.RemoteAddr, statusCode, path)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			handleHeadMiss(w, r, reponame, repo, path, filename)
 			return
 		}
 
@@ -82,11 +135,40 @@ func proxyHandler(repos map[string]*Repo) http.HandlerFunc {
 	}
 }
 
-func handleHit(w http.ResponseWriter, r *http.Request, path string, cache *os.File) {
+// readHitMeta reads metadata of cached file. Errors are only logged, as the
+// file can still be served without metadata.
+func readHitMeta(r *http.Request, reponame, path, filename string, cache *os.File) *CacheMeta {
+	meta, err := readCacheMeta(cache, reponame, filename)
+	if err != nil {
+		error_count.Inc()
+		log.Printf("MID %s   - %q Failed to read cached file metadata, using defaults. Error: %v", r.RemoteAddr, path, err)
+	}
+	return meta
+}
+
+// serveCached serves file that was just put in the cache (or revalidated) by
+// a fetch.
+func serveCached(w http.ResponseWriter, r *http.Request, reponame string, repo *Repo, path, filename string) {
+	cache, cachedName, err := openCached(reponame, filename, repo.forwardHeaders(r))
+	if err != nil {
+		error_count.Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 Internal Server Error\n\nCould not open cached file\n"))
+		log.Printf("END %s 500 %q Failed to open just fetched cache file. Error: %v", r.RemoteAddr, path, err)
+		return
+	}
+	defer cache.Close()
+	handleHit(w, r, repo, path, cachedName, cache, readHitMeta(r, reponame, path, cachedName, cache))
+}
+
+// handleHit serves a cached file. cachedName is its filename relative to
+// final/ (different from the requested one for variants, see vary.go).
+func handleHit(w http.ResponseWriter, r *http.Request, repo *Repo, path, cachedName string, cache *os.File, meta *CacheMeta) {
 	hit_requests_in_progress.Inc()
 	defer func() {
 		hit_requests_in_progress.Dec()
 	}()
+	repo.access.record(cachedName)
 
 	fi, err := cache.Stat()
 	if err != nil {
@@ -96,38 +178,40 @@ func handleHit(w http.ResponseWriter, r *http.Request, path string, cache *os.Fi
 		log.Printf("END %s 500 %q Failed to call f.Stat(). Error: %v", r.RemoteAddr, path, err)
 		return
 	}
+	setMetaHeaders(w.Header(), meta)
+	if variantOf(cachedName) != cachedName {
+		// Variants are in the same directory as the names, see vary.go.
+		names, _ := readVaryNames(filepath.Dir(cache.Name()))
+		setVaryHeader(w.Header(), names, false)
+	}
+
 	fileSize := fi.Size()
 	log.Printf("MID %s 200 %q Cache hit, %d bytes - serving", r.RemoteAddr, path, fileSize)
 	t1 := time.Now()
-	w.Header().Set("Content-Length", strconv.Itoa(int(fileSize)))
-	w.WriteHeader(http.StatusOK)
 
-	// io.Copy uses 32KiB buffer by default if it needs to.
-	// But also io.Copy for suitable files, uses Linux sendfile,
-	// which is in this case, from file to unencrypted socket.
+	// http.ServeContent handles Range, If-Range (including multipart/byteranges
+	// and 416 responses), and conditional requests (If-Match, If-None-Match,
+	// If-Modified-Since, If-Unmodified-Since) using ETag and modification
+	// time. For single range and full file responses, it uses
+	// io.CopyN from the file, which for suitable files still uses Linux
+	// sendfile, which is in this case, from file to unencrypted socket.
 	// From strace it looks like it is sending in 4MiB chunks.
-	bytesCopiedCount, err := io.Copy(w, cache)
-
-	// buf := make([]byte, 1024*1024)
-	// bytesCopiedCount, err := io.CopyBuffer(w, cache, buf)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, path, cacheModTime(meta, fi), cache)
 
 	// n, err := syscall.Sendfile(int(w.Fd()), int(cache.Fd()), nil, int(fileSize))
 	// if err == syscall.EAGAIN
 
-	if err != nil {
+	if expected := cw.expectedBodySize(r); cw.count != expected {
 		error_count.Inc()
-		log.Printf("END %s   - %q Cache hit, %d bytes - premature error after %d / %d bytes in %v. Error: %v", r.RemoteAddr, path, fileSize, bytesCopiedCount, fileSize, time.Since(t1), err)
+		log.Printf("END %s   - %q Cache hit, %d bytes - premature error after %d / %d bytes in %v", r.RemoteAddr, path, fileSize, cw.count, expected, time.Since(t1))
 		panic(http.ErrAbortHandler)
 	}
-	// w.Close()
-	flusher := w.(http.Flusher)
-	if flusher != nil {
-		flusher.Flush()
-	}
-	_ = bytesCopiedCount
-	log.Printf("END %s 200 %q Cache hit, %d bytes - served in %v", r.RemoteAddr, path, fileSize, time.Since(t1))
+	cw.Flush()
+	countConditionalResponse(cw.status)
+	log.Printf("END %s %d %q Cache hit, %d bytes - served %d bytes in %v", r.RemoteAddr, cw.status, path, fileSize, cw.count, time.Since(t1))
 	hit_count.Inc()
-	hit_bytes.Add(float64(bytesCopiedCount))
+	hit_bytes.Add(float64(cw.count))
 	return
 }
 
@@ -141,122 +225,298 @@ func handleMiss(w http.ResponseWriter, r *http.Request, reponame string, repo *R
 	defer func() {
 		miss_requests_in_progress.Dec()
 	}()
+
+	forward := repo.forwardHeaders(r)
+	f, started, err := repo.startFetch(reponame, filename, cacheFilename, false, nil, forward)
+	if err != nil {
+		error_count.Inc()
+		log.Printf("MID0 %s 500 %q Cache miss and fs error %v", r.RemoteAddr, path, err)
+		handleMissUncached(w, r, repo, path, filename)
+		return
+	}
+	if f == nil {
+		// Other request finished fetching it just now.
+		serveCached(w, r, reponame, repo, path, filename)
+		return
+	}
+	defer f.release()
 	miss_count.Inc()
-	resp, err := http.Get(repo.upstreamURLBase + filename)
+	if !started {
+		coalesced_miss_count.Inc()
+	}
+
+	if err := f.waitHeaders(r.Context()); err != nil {
+		log.Printf("END %s   - %q Cache miss and client gone while waiting for upstream response. Error: %v", r.RemoteAddr, path, err)
+		return
+	}
+	if f.statusCode == 0 {
+		// Upstream request failed before any response.
+		if errors.Is(f.err, errCircuitOpen) {
+			writeCircuitOpen(w, r, repo, path, "Cache miss")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 Internal Server Error\n\nProxy request " + filename + " failed\n"))
+		log.Printf("END %s 500 %q Cache miss and upstream request error %v", r.RemoteAddr, path, f.err)
+		return
+	}
+	if f.statusCode == http.StatusNotModified {
+		// Joined revalidation of a file that is in the cache after all.
+		serveCached(w, r, reponame, repo, path, filename)
+		return
+	}
+	if f.location != "" {
+		writeRedirect(w, r, path, "Cache miss", f.statusCode, f.location)
+		return
+	}
+	if f.statusCode != 200 {
+		w.WriteHeader(f.statusCode)
+		log.Printf("END %s %d %q Cache miss and upstream response error", r.RemoteAddr, f.statusCode, path)
+		return
+	}
+	if !repo.fetchServes(f, forward) {
+		log.Printf("MID %s   - %q Cache miss, and joined fetch is of another variant, fetching separately", r.RemoteAddr, path)
+		handleMissUncached(w, r, repo, path, filename)
+		return
+	}
+
+	serveFetch(w, r, f, path, started)
+}
+
+// serveFetch serves the file from in-progress fetch, with successful
+// upstream response.
+func serveFetch(w http.ResponseWriter, r *http.Request, f *fetch, path string, started bool) {
+	setMetaHeaders(w.Header(), f.meta)
+	setVaryHeader(w.Header(), f.varyNames, f.varyStar)
+	if started {
+		log.Printf("MID %s 200 %q Cache miss - serving expected %d bytes from upstream", r.RemoteAddr, path, f.contentLength)
+	} else {
+		log.Printf("MID %s 200 %q Cache miss - joined in-progress fetch, serving expected %d bytes", r.RemoteAddr, path, f.contentLength)
+	}
+	t1 := time.Now()
+
+	if f.contentLength < 0 {
+		// Unknown size (i.e. chunked upstream response). Ranges cannot be
+		// served until it finishes, so stream the full file instead.
+		w.WriteHeader(http.StatusOK)
+		bytesCopiedCount, err := f.copyTo(r.Context(), w, 0, -1)
+		miss_bytes.Add(float64(bytesCopiedCount))
+		if err != nil {
+			error_count.Inc()
+			log.Printf("END %s 5xx %q Cache miss and writing to client socket or fetching from upstream failed after %d bytes, aborting response (fetch to disk continues if possible). Error: %v", r.RemoteAddr, path, bytesCopiedCount, err)
+			panic(http.ErrAbortHandler)
+		}
+		log.Printf("END %s 2xx %q Finished streaming to client. %d bytes in %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
+		return
+	}
+
+	// Serve (possibly ranged) response from the file being fetched. Reads
+	// block until the requested part of the file arrives from upstream.
+	cw := &countingResponseWriter{ResponseWriter: w}
+	fr := &fetchReader{ctx: r.Context(), f: f}
+	http.ServeContent(cw, r, path, cacheModTime(f.meta, nil), fr)
+	miss_bytes.Add(float64(cw.count))
+	if expected := cw.expectedBodySize(r); cw.count != expected {
+		error_count.Inc()
+		log.Printf("END %s 5xx %q Cache miss and writing to client socket or fetching from upstream failed after %d / %d bytes, aborting response (fetch to disk continues if possible). Error: %v", r.RemoteAddr, path, cw.count, expected, fr.err)
+		panic(http.ErrAbortHandler)
+	}
+	countConditionalResponse(cw.status)
+	log.Printf("END %s %d %q Finished streaming to client. %d bytes in %v", r.RemoteAddr, cw.status, path, cw.count, time.Since(t1))
+}
+
+func countConditionalResponse(status int) {
+	switch status {
+	case http.StatusPartialContent:
+		partial_response_count.Inc()
+	case http.StatusNotModified:
+		not_modified_count.Inc()
+	case http.StatusPreconditionFailed:
+		precondition_failed_count.Inc()
+	}
+}
+
+// writeCircuitOpen fails the request fast, when upstream was not contacted,
+// because circuit breaker is open.
+func writeCircuitOpen(w http.ResponseWriter, r *http.Request, repo *Repo, path, what string) {
+	retryAfter := int(math.Ceil(repo.circuitRetryAfter().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("503 Service Unavailable\n\nUpstream is failing, and file is not in the cache\n"))
+	log.Printf("END %s 503 %q %s and circuit breaker open", r.RemoteAddr, path, what)
+}
+
+// writeRedirect relays upstream redirect to the client, see
+// RedirectPolicy.Relay.
+func writeRedirect(w http.ResponseWriter, r *http.Request, path, what string, statusCode int, location string) {
+	w.Header().Set("Location", location)
+	w.WriteHeader(statusCode)
+	log.Printf("END %s %d %q %s and upstream redirect relayed", r.RemoteAddr, statusCode, path, what)
+}
+
+// handleHeadMiss answers HEAD request for a file not in the cache, by
+// making HEAD request to upstream. Cache is not populated.
+func handleHeadMiss(w http.ResponseWriter, r *http.Request, reponame string, repo *Repo, path, filename string) {
+	head_miss_count.Inc()
+	forward := repo.forwardHeaders(r)
+	resp, err := repo.doUpstream(http.MethodHead, filename, func(req *http.Request) {
+		setForwardHeaders(req, forward)
+	})
+	if errors.Is(err, errCircuitOpen) {
+		writeCircuitOpen(w, r, repo, path, "HEAD cache miss")
+		return
+	}
 	if err != nil {
 		upstream_error_count.Inc()
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 Internal Server Error\n\nProxy request " + filename + " failed\n"))
-		log.Printf("END %s 500 %q Cache miss and upstream request error %v", r.RemoteAddr, path, err)
+		log.Printf("END %s 500 %q HEAD cache miss and upstream request error %v", r.RemoteAddr, path, err)
+		return
+	}
+	resp.Body.Close()
+	if location, err := resp.Location(); err == nil && isRedirect(resp.StatusCode) {
+		redirect_relayed_count.Inc()
+		writeRedirect(w, r, path, "HEAD cache miss", resp.StatusCode, location.String())
 		return
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		upstream_error_count.Inc()
+		repo.storeNegative(reponame, filename, resp.StatusCode)
 		w.WriteHeader(resp.StatusCode)
-		log.Printf("END %s %d %q Cache miss and upstream response error", r.RemoteAddr, resp.StatusCode, path)
+		log.Printf("END %s %d %q HEAD cache miss and upstream response error", r.RemoteAddr, resp.StatusCode, path)
 		return
 	}
-	// w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-
-	contentLength := resp.Header.Get("Content-Length")
+	for _, header := range []string{"Content-Length", "Content-Type", "Last-Modified", "ETag"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	for name, values := range repo.responseHeaders(resp.Header) {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(http.StatusOK)
+	log.Printf("END %s 200 %q HEAD cache miss, upstream size %q", r.RemoteAddr, path, resp.Header.Get("Content-Length"))
+}
 
-	cacheTemp, err := NewTempFile("cache/"+reponame+"/temp", filename, cacheFilename)
+// handleRevalidate serves a cached file, which might be stale, after
+// checking with upstream if it changed. If it did, the new version is
+// fetched (and served) instead.
+func handleRevalidate(w http.ResponseWriter, r *http.Request, reponame string, repo *Repo, path, filename, cacheFilename string, cache *os.File, meta *CacheMeta) {
+	cachedName := strings.TrimPrefix(cacheFilename, "cache/"+reponame+"/final/")
+	revalidation_count.Inc()
+	forward := repo.forwardHeaders(r)
+	f, started, err := repo.startFetch(reponame, filename, cacheFilename, true, meta, forward)
 	if err != nil {
 		error_count.Inc()
-		log.Printf("MID0 %s 500 %q Cache miss and fs error %v", r.RemoteAddr, path, err)
+		log.Printf("MID %s   - %q Cache hit, but stale, and failed to start revalidation, serving stale. Error: %v", r.RemoteAddr, path, err)
+		stale_served_count.Inc()
+		w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+		handleHit(w, r, repo, path, cachedName, cache, meta)
+		return
+	}
+	defer f.release()
 
-		// Fallback to streaming directly to user only.
-		if contentLength != "" {
-			w.Header().Set("Content-Length", contentLength)
+	if err := f.waitHeaders(r.Context()); err != nil {
+		log.Printf("END %s   - %q Cache hit, but stale, and client gone while waiting for upstream response. Error: %v", r.RemoteAddr, path, err)
+		return
+	}
+	switch f.statusCode {
+	case http.StatusOK:
+		revalidation_refresh_count.Inc()
+		if !repo.fetchServes(f, forward) {
+			log.Printf("MID %s   - %q Cache hit, but stale, and changed upstream to another variant, fetching separately", r.RemoteAddr, path)
+			handleMissUncached(w, r, repo, path, filename)
+			return
 		}
-		w.WriteHeader(http.StatusOK)
-		t1 := time.Now()
-		bytesCopiedCount, err := io.Copy(w, resp.Body)
-		if err != nil {
-			upstream_error_count.Inc()
-			error_count.Inc()
-			log.Printf("END %s 5xx %q Writing to client socket or reading from upstream socket failed after %d bytes, aborting response. Error: %v", r.RemoteAddr, path, bytesCopiedCount, err)
-			panic(http.ErrAbortHandler)
+		log.Printf("MID %s 200 %q Cache hit, but stale, and changed upstream - refreshing", r.RemoteAddr, path)
+		serveFetch(w, r, f, path, started)
+	case http.StatusNotModified:
+		log.Printf("MID %s 200 %q Cache hit, but stale, and not modified upstream", r.RemoteAddr, path)
+		handleHit(w, r, repo, path, cachedName, cache, meta)
+	default:
+		revalidation_error_count.Inc()
+		if !repo.canServeStaleOnError(filename, meta, cache) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte("504 Gateway Timeout\n\nRevalidation of stale cached file failed, and upstream does not allow serving it stale\n"))
+			log.Printf("END %s 504 %q Cache hit, but stale, and revalidation failed (status %d, error %v), stale-if-error exceeded", r.RemoteAddr, path, f.statusCode, f.err)
+			return
 		}
-		resp.Body.Close()
-		log.Printf("END %s 2xx %q Finished streaming to client (without saving to cache due to previous errors). %d bytes in %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
-		miss_bytes.Add(float64(bytesCopiedCount))
+		log.Printf("MID %s   - %q Cache hit, but stale, and revalidation failed (status %d, error %v), serving stale", r.RemoteAddr, path, f.statusCode, f.err)
+		stale_served_count.Inc()
+		w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+		handleHit(w, r, repo, path, cachedName, cache, meta)
+	}
+}
+
+// revalidateInBackground starts revalidation of a stale cached file,
+// without waiting for it (stale-while-revalidate).
+func revalidateInBackground(r *http.Request, reponame string, repo *Repo, path, filename, cacheFilename string, meta *CacheMeta) {
+	revalidation_count.Inc()
+	stale_while_revalidate_count.Inc()
+	f, _, err := repo.startFetch(reponame, filename, cacheFilename, true, meta, repo.forwardHeaders(r))
+	if err != nil {
+		error_count.Inc()
+		log.Printf("MID %s   - %q Cache hit, but stale, and failed to start background revalidation. Error: %v", r.RemoteAddr, path, err)
+		return
+	}
+	// Fetch continues on its own.
+	f.release()
+	log.Printf("MID %s   - %q Cache hit, but stale, revalidating in background", r.RemoteAddr, path)
+}
+
+// handleMissUncached streams file from upstream directly to the client,
+// without saving it to the cache. Used as a fallback when temporary cache
+// file cannot be created, or for a client which joined a fetch of another
+// variant.
+func handleMissUncached(w http.ResponseWriter, r *http.Request, repo *Repo, path, filename string) {
+	miss_count.Inc()
+	forward := repo.forwardHeaders(r)
+	resp, err := repo.doUpstream(http.MethodGet, filename, func(req *http.Request) {
+		setForwardHeaders(req, forward)
+	})
+	if errors.Is(err, errCircuitOpen) {
+		writeCircuitOpen(w, r, repo, path, "Cache miss")
+		return
+	}
+	if err != nil {
+		upstream_error_count.Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 Internal Server Error\n\nProxy request " + filename + " failed\n"))
+		log.Printf("END %s 500 %q Cache miss and upstream request error %v", r.RemoteAddr, path, err)
+		return
+	}
+	defer resp.Body.Close()
+	if location, err := resp.Location(); err == nil && isRedirect(resp.StatusCode) {
+		redirect_relayed_count.Inc()
+		writeRedirect(w, r, path, "Cache miss", resp.StatusCode, location.String())
+		return
+	}
+	if resp.StatusCode != 200 {
+		upstream_error_count.Inc()
+		w.WriteHeader(resp.StatusCode)
+		log.Printf("END %s %d %q Cache miss and upstream response error", r.RemoteAddr, resp.StatusCode, path)
 		return
 	}
-	defer func() {
-		err := cacheTemp.Cleanup()
-		if err != nil {
-			error_count.Inc()
-			log.Printf("FIN %s   - %q Sending response or saving to cache failed, and temporary file cleanup failed. Error: %v", r.RemoteAddr, path, err)
-		}
-		update_free_disk_space()
-	}()
 
+	meta := newCacheMeta(redactURL(resp.Request.URL), resp)
+	meta.Headers = repo.responseHeaders(resp.Header)
+	setMetaHeaders(w.Header(), meta)
+	varyNames, varyStar := repo.varyNames(resp.Header)
+	setVaryHeader(w.Header(), varyNames, varyStar)
+	contentLength := resp.Header.Get("Content-Length")
 	if contentLength != "" {
 		w.Header().Set("Content-Length", contentLength)
 	}
 	w.WriteHeader(http.StatusOK)
-	log.Printf("MID %s 200 %q Cache miss - serving expected %q bytes from upstream", r.RemoteAddr, path, contentLength)
-
-	// Note, we do not use io.MultiWriter, because in case writing to file fails,
-	// we want to continue proxing the request.
 	t1 := time.Now()
-	bytesCopiedCount := 0
-	buf := make([]byte, BUFFERSIZE)
-	abandonCacheFile := false
-	abandonClientWrite := false
-	for {
-		n, err := resp.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			upstream_error_count.Inc()
-			panic(http.ErrAbortHandler)
-		}
-		if n == 0 {
-			break
-		}
-		if !abandonClientWrite {
-			if n1, err := w.Write(buf[:n]); err != nil || n1 != n {
-				error_count.Inc()
-				log.Printf("MID %s 5xx %q Cache miss and writing to socket failed after %d bytes, aborting response write, but continue with fetching to disk. Error: %v", r.RemoteAddr, path, bytesCopiedCount, err)
-				abandonClientWrite = true
-			}
-		}
-		if !abandonCacheFile {
-			if n2, err := cacheTemp.File().Write(buf[:n]); err != nil || n2 != n {
-				error_count.Inc()
-				log.Printf("MID0 %s 200 %q Cache miss and write error to cache file after %d bytes. Attempted to write %d bytes, wrote %d bytes. Error: %v", r.RemoteAddr, path, bytesCopiedCount, n, n2, err)
-				abandonCacheFile = true
-			}
-		}
-		if abandonClientWrite && abandonCacheFile {
-			log.Printf("END %s 5xx %q Cache miss and write error to both client and cache file about %d bytes. Aborting handler (will also cleanup temporary file) after %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
-			panic(http.ErrAbortHandler)
-		}
-		bytesCopiedCount += n
+	bytesCopiedCount, err := io.Copy(w, resp.Body)
+	upstream_fetch_bytes.Add(float64(bytesCopiedCount))
+	if err != nil {
+		upstream_error_count.Inc()
+		error_count.Inc()
+		log.Printf("END %s 5xx %q Writing to client socket or reading from upstream socket failed after %d bytes, aborting response. Error: %v", r.RemoteAddr, path, bytesCopiedCount, err)
+		panic(http.ErrAbortHandler)
 	}
-
 	resp.Body.Close()
+	log.Printf("END %s 2xx %q Finished streaming to client (without saving to cache due to previous errors). %d bytes in %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
 	miss_bytes.Add(float64(bytesCopiedCount))
-
-	if abandonCacheFile {
-		log.Printf("END %s 2xx %q Finished streaming to client (writing to cache file aborted due to errors). %d bytes in %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
-	} else {
-		log.Printf("END %s 2xx %q Finished streaming to client and to cache file. %d bytes in %v", r.RemoteAddr, path, bytesCopiedCount, time.Since(t1))
-
-		lastSlash := strings.LastIndex(filename, "/")
-		if lastSlash != -1 {
-			err = os.MkdirAll("cache/"+reponame+"/final/"+filename[0:lastSlash], 0750)
-			if err != nil {
-				error_count.Inc()
-				log.Printf("FIN %s   - %q Failed creating final subdirectory for cache file. Error: %v", r.RemoteAddr, path, err)
-				return
-			}
-		}
-		err = cacheTemp.Finalize()
-		if err != nil {
-			error_count.Inc()
-			log.Printf("FIN %s   - %q Failed closing or moving temporary cache file. Error: %v", r.RemoteAddr, path, err)
-		}
-	}
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chdirTestCache changes to a temporary directory with the cache of repo
+// "r", for the duration of the test.
+func chdirTestCache(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, dir := range []string{"temp", "final", "negative", "access"} {
+		if err := os.MkdirAll("cache/r/"+dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestProxy starts proxy with a single repo "r" in a temporary directory,
+// with the given upstream.
+func newTestProxy(t *testing.T, upstream http.Handler) (*Repo, *httptest.Server) {
+	t.Helper()
+	chdirTestCache(t)
+
+	upstreamServer := httptest.NewServer(upstream)
+	t.Cleanup(upstreamServer.Close)
+	repo := &Repo{
+		fetches:        make(map[string]*fetch),
+		redirectPolicy: defaultRedirectPolicy(),
+		proxy:          http.ProxyFromEnvironment,
+	}
+	repo.upstreams = append(repo.upstreams, newUpstream("r", upstreamServer.URL+"/"))
+	repo.client = newUpstreamClient(defaultUpstreamClientOption(), nil, "", repo.proxy)
+	repo.client.CheckRedirect = repo.checkRedirect
+	var err error
+	repo.access, err = loadAccessIndex("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(proxyHandler(map[string]*Repo{"r": repo}))
+	t.Cleanup(proxy.Close)
+	return repo, proxy
+}
+
+// fetchRefs returns number of references to the in-progress fetch of the
+// file, 0 if there is none.
+func fetchRefs(repo *Repo, filename string) int {
+	repo.fetchesMu.Lock()
+	defer repo.fetchesMu.Unlock()
+	f, ok := repo.fetches[filename]
+	if !ok {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refs
+}
+
+// waitFetches waits until there are no fetches in progress.
+func waitFetches(t *testing.T, repo *Repo) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		repo.fetchesMu.Lock()
+		n := len(repo.fetches)
+		repo.fetchesMu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatalf("Fetches still in progress")
+}
+
+func TestCacheMissCoalescing(t *testing.T) {
+	const clients = 5
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var requests atomic.Int32
+	release := make(chan struct{})
+	repo, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:10])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(content[10:])
+	}))
+
+	var wg sync.WaitGroup
+	bodies := make([][]byte, clients)
+	errs := make([]error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(proxy.URL + "/proxy/r/dir/file.jar")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			bodies[i], errs[i] = io.ReadAll(resp.Body)
+		}(i)
+	}
+	// All clients joined the fetch, plus the download goroutine.
+	for deadline := time.Now().Add(5 * time.Second); fetchRefs(repo, "dir/file.jar") < clients+1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("Clients did not join the fetch, %d references", fetchRefs(repo, "dir/file.jar"))
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < clients; i++ {
+		if errs[i] != nil {
+			t.Errorf("Client %d error: %v", i, errs[i])
+		} else if string(bodies[i]) != string(content) {
+			t.Errorf("Client %d got %q, want %q", i, bodies[i], content)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Upstream got %d requests, want 1", got)
+	}
+	waitFetches(t, repo)
+	cached, err := os.ReadFile("cache/r/final/dir/file.jar")
+	if err != nil || string(cached) != string(content) {
+		t.Errorf("Cached file %q (error %v), want %q", cached, err, content)
+	}
+
+	// Now a cache hit.
+	resp, err := http.Get(proxy.URL + "/proxy/r/dir/file.jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != string(content) || requests.Load() != 1 {
+		t.Errorf("Cache hit got %q with %d upstream requests", body, requests.Load())
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	release := make(chan struct{})
+	repo, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			t.Errorf("Range forwarded to upstream on cache miss: %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(content[:10])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(content[10:])
+	}))
+
+	get := func(header http.Header) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/proxy/r/file", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	// Cache miss, range partially beyond data received so far.
+	go func() {
+		for fetchRefs(repo, "file") < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	resp, body := get(http.Header{"Range": {"bytes=5-14"}})
+	if resp.StatusCode != http.StatusPartialContent || body != string(content[5:15]) {
+		t.Fatalf("Cache miss range got %d %q, want 206 %q", resp.StatusCode, body, content[5:15])
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 5-14/36" {
+		t.Errorf("Cache miss Content-Range %q", got)
+	}
+	waitFetches(t, repo)
+
+	tests := []struct {
+		header http.Header
+		status int
+		body   string
+	}{
+		{http.Header{"Range": {"bytes=0-3"}}, http.StatusPartialContent, "0123"},
+		{http.Header{"Range": {"bytes=-4"}}, http.StatusPartialContent, "wxyz"},
+		{http.Header{"Range": {"bytes=30-"}}, http.StatusPartialContent, "uvwxyz"},
+		{http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"v1"`}}, http.StatusPartialContent, "0123"},
+		{http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"v0"`}}, http.StatusOK, string(content)},
+		{http.Header{"Range": {"bytes=100-"}}, http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, test := range tests {
+		resp, body := get(test.header)
+		if resp.StatusCode != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("Cache hit with %v got %d %q, want %d %q", test.header, resp.StatusCode, body, test.status, test.body)
+		}
+	}
+}
+
+func TestCacheMissCoalescingVariants(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	repo, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Vary", "Accept, Accept-Language")
+		w.Header().Set("Content-Length", "7")
+		io.WriteString(w, "accept")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, r.Header.Get("Accept"))
+	}))
+	repo.forwardRequestHeaders = []string{"Accept", "User-Agent"}
+
+	type result struct {
+		body, vary string
+		err        error
+	}
+	get := func(accept, userAgent string) result {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/proxy/r/file", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return result{err: err}
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return result{string(body), resp.Header.Get("Vary"), err}
+	}
+
+	// Variants are not known yet, so all clients join the first fetch, even
+	// with different User-Agent, which upstream does not vary on.
+	clients := []struct{ accept, userAgent string }{{"a", "ua1"}, {"a", "ua2"}, {"b", "ua3"}}
+	results := make([]result, len(clients))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, accept, userAgent string) {
+			defer wg.Done()
+			results[i] = get(accept, userAgent)
+		}(i, client.accept, client.userAgent)
+		for deadline := time.Now().Add(5 * time.Second); fetchRefs(repo, "file") < i+2; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				close(release)
+				t.Fatalf("Client %d did not join the fetch", i)
+			}
+		}
+	}
+	close(release)
+	wg.Wait()
+	waitFetches(t, repo)
+
+	// Client with another Accept is served the right variant separately.
+	want := []string{"accepta", "accepta", "acceptb"}
+	for i, result := range results {
+		if result.err != nil || result.body != want[i] || result.vary != "Accept" {
+			t.Errorf("Client %d got %q, Vary %q, error %v, want %q", i, result.body, result.vary, result.err, want[i])
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Upstream got %d requests, want 2", got)
+	}
+
+	// Cache hit of the variant, and miss of the other one.
+	if result := get("a", "ua4"); result.err != nil || result.body != "accepta" || result.vary != "Accept" {
+		t.Errorf("Cache hit got %q, Vary %q, error %v", result.body, result.vary, result.err)
+	}
+	if result := get("b", "ua4"); result.err != nil || result.body != "acceptb" || result.vary != "Accept" {
+		t.Errorf("Cache miss of another variant got %q, Vary %q, error %v", result.body, result.vary, result.err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("Upstream got %d requests, want 3", got)
+	}
+	waitFetches(t, repo)
+	if fetchKey("r", "file", http.Header{"Accept": {"a"}, "User-Agent": {"x"}}) != fetchKey("r", "file", http.Header{"Accept": {"a"}}) {
+		t.Errorf("fetchKey depends on headers upstream does not vary on")
+	}
+	if fetchKey("r", "file", http.Header{"Accept": {"a"}}) == fetchKey("r", "file", http.Header{"Accept": {"b"}}) {
+		t.Errorf("fetchKey does not depend on headers upstream varies on")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errRedirectRejected = errors.New("Upstream redirect rejected by redirect policy")
+
+// checkRedirect applies redirect policy of the repo to file downloads. Used
+// as http.Client.CheckRedirect.
+func (repo *Repo) checkRedirect(req *http.Request, via []*http.Request) error {
+	if repo.redirectPolicy.Relay {
+		return http.ErrUseLastResponse
+	}
+	return repo.followRedirect(req, via)
+}
+
+// followRedirect checks if redirect can be followed, and removes credentials
+// from the redirected request, if needed. Also used for prefetch listing,
+// which cannot be relayed.
+func (repo *Repo) followRedirect(req *http.Request, via []*http.Request) error {
+	policy := repo.redirectPolicy
+	if len(via) > policy.MaxHops {
+		redirect_rejected_count.Inc()
+		return fmt.Errorf("%w. More than %d redirects", errRedirectRejected, policy.MaxHops)
+	}
+	original := via[0].URL
+	crossHost := !strings.EqualFold(req.URL.Host, original.Host)
+	if crossHost && len(policy.AllowHosts) > 0 && !redirectHostAllowed(policy.AllowHosts, req.URL.Hostname()) {
+		redirect_rejected_count.Inc()
+		return fmt.Errorf("%w. Host %q not allowed", errRedirectRejected, req.URL.Hostname())
+	}
+	if crossHost {
+		// Go only removes Authorization header on redirects to other
+		// domains, but not other credential headers.
+		if policy.ForwardAuth {
+			repo.auth.apply(req)
+		} else {
+			repo.auth.remove(req)
+		}
+	}
+	upstream_redirect_count.Inc()
+	return nil
+}
+
+// redirectHostAllowed checks host against allowed hosts. Entries starting
+// with "." match all subdomains.
+func redirectHostAllowed(allowHosts []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range allowHosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectChain returns URLs of requests which were redirected before
+// getting resp, in order, starting with the original one.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		chain = append([]string{redactURL(req.Response.Request.URL)}, chain...)
+	}
+	return chain
+}
+
+// redactURL returns URL without credentials and query, which in redirects
+// to blob storage usually contains (expiring) signatures.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = ""
+	redacted.ForceQuery = false
+	redacted.Fragment = ""
+	return redacted.String()
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// countingResponseWriter counts body bytes written to the client, and
+// remembers response status code.
+//
+// It implements io.ReaderFrom, so io.Copy from *os.File into it, still uses
+// sendfile of the underlying connection.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.count += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.count += n
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// expectedBodySize returns number of body bytes that should have been written,
+// according to the request method, status code and Content-Length header sent.
+// Returns number of bytes actually written, if it cannot be determined.
+func (w *countingResponseWriter) expectedBodySize(r *http.Request) int64 {
+	if r.Method == http.MethodHead {
+		return 0
+	}
+	if w.status != http.StatusOK && w.status != http.StatusPartialContent {
+		return w.count
+	}
+	contentLength, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return w.count
+	}
+	return contentLength
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// statusHandler shows a simple human readable status of repos and their
+// upstreams.
+func statusHandler(repos map[string]*Repo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reponames := make([]string, 0, len(repos))
+		for reponame := range repos {
+			reponames = append(reponames, reponame)
+		}
+		sort.Strings(reponames)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(w, "nexus-proxy status\n\n")
+		for _, reponame := range reponames {
+			repo := repos[reponame]
+			repo.fetchesMu.Lock()
+			fetches := len(repo.fetches)
+			repo.fetchesMu.Unlock()
+
+			fmt.Fprintf(w, "repo %s\n", reponame)
+			if repo.offline {
+				fmt.Fprintf(w, "  offline mode\n")
+			}
+			fmt.Fprintf(w, "  fetches in progress: %d\n", fetches)
+			for _, u := range repo.upstreams {
+				u.mu.Lock()
+				health := "healthy"
+				if !u.healthy {
+					health = "unhealthy"
+				}
+				since := time.Since(u.changed).Truncate(time.Second)
+				lastError := u.lastError
+				resolved := u.resolved
+				u.mu.Unlock()
+
+				fmt.Fprintf(w, "  upstream %s\n", u.base)
+				fmt.Fprintf(w, "    %s for %v\n", health, since)
+				if !resolved {
+					fmt.Fprintf(w, "    hostname not resolved\n")
+				}
+				if u.breaker != nil {
+					fmt.Fprintf(w, "    circuit breaker %s\n", u.breaker.getState())
+				}
+				if lastError != "" {
+					fmt.Fprintf(w, "    last error: %s\n", lastError)
+				}
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+// readyHandler responds with 200, if for every repo (not in offline mode)
+// hostname of at least one upstream URL can be resolved, and with 503
+// otherwise, or if hostnames were not resolved yet since start. Cache hits
+// are served either way.
+func readyHandler(repos map[string]*Repo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !upstreamsResolved.Load() {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "upstream hostnames not resolved yet\n")
+			return
+		}
+		reponames := make([]string, 0, len(repos))
+		for reponame := range repos {
+			reponames = append(reponames, reponame)
+		}
+		sort.Strings(reponames)
+
+		var notReady []string
+		for _, reponame := range reponames {
+			repo := repos[reponame]
+			if repo.offline {
+				continue
+			}
+			resolved := false
+			for _, u := range repo.upstreams {
+				if u.isResolved() {
+					resolved = true
+					break
+				}
+			}
+			if !resolved {
+				notReady = append(notReady, reponame)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if len(notReady) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, reponame := range notReady {
+				fmt.Fprintf(w, "repo %s: no upstream hostname can be resolved\n", reponame)
+			}
+			return
+		}
+		fmt.Fprintf(w, "ready\n")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	defer upstreamsResolved.Store(upstreamsResolved.Load())
+	upstreamsResolved.Store(false)
+	u := newUpstream("ready_test", "http://nexus.invalid/")
+	repos := map[string]*Repo{
+		"r":       {upstreams: []*upstream{u}},
+		"offline": {upstreams: []*upstream{newUpstream("ready_test", "http://other.invalid/")}, offline: true},
+	}
+	repos["offline"].upstreams[0].resolved = false
+	handler := readyHandler(repos)
+	status := func() int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Status before first resolve = %d, want 503", got)
+	}
+	upstreamsResolved.Store(true)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Status with resolved upstream = %d, want 200", got)
+	}
+	u.resolved = false
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Status with unresolved upstream = %d, want 503", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	// "log"
+	"io"
 	"os"
 	"strconv"
 	"syscall"
@@ -13,6 +14,7 @@ import (
 type TempFile struct {
 	fd        int
 	temp      *os.File
+	dir       string
 	finalPath string
 	o_tmpfile bool
 }
@@ -27,6 +29,7 @@ func NewTempFile(dir, filename, finalPath string) (*TempFile, error) {
 		return &TempFile{
 			fd:        fd,
 			temp:      f,
+			dir:       dir,
 			finalPath: finalPath,
 			o_tmpfile: true,
 		}, nil
@@ -61,6 +64,7 @@ func NewTempFile(dir, filename, finalPath string) (*TempFile, error) {
 	}
 	return &TempFile{
 		temp:      temp,
+		dir:       dir,
 		finalPath: finalPath,
 	}, nil
 }
@@ -118,6 +122,26 @@ func (t *TempFile) Finalize() error {
 		// use using it in linkat.
 		err := unix.Linkat(unix.AT_FDCWD, t.temp.Name(), unix.AT_FDCWD, t.finalPath,
 			unix.AT_SYMLINK_FOLLOW)
+		if err == unix.EEXIST {
+			// Replacing existing file (i.e. refreshed from upstream). Linkat
+			// cannot do it, so link it under unique name in temporary
+			// directory first, and then atomically rename over existing one.
+			replacePath := t.dir + "/replace_" + strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + strconv.Itoa(t.fd)
+			err = unix.Linkat(unix.AT_FDCWD, t.temp.Name(), unix.AT_FDCWD, replacePath,
+				unix.AT_SYMLINK_FOLLOW)
+			if err == nil {
+				err = os.Rename(replacePath, t.finalPath)
+				if err != nil {
+					os.Remove(replacePath)
+				}
+				err2 := t.temp.Close()
+				t.temp = nil
+				if err != nil {
+					return err
+				}
+				return err2
+			}
+		}
 		if err != nil {
 			err = &os.LinkError{
 				Op:  "link",
@@ -134,3 +158,44 @@ func (t *TempFile) Finalize() error {
 		return err2
 	}
 }
+
+// SetFinalPath changes where Finalize moves the file.
+func (t *TempFile) SetFinalPath(finalPath string) {
+	t.finalPath = finalPath
+}
+
+// Persist closes the temporary file, but keeps its content under path,
+// instead of removing it. Used to keep partially downloaded files.
+func (t *TempFile) Persist(path string) error {
+	var err error
+	if t.o_tmpfile {
+		err = unix.Linkat(unix.AT_FDCWD, t.temp.Name(), unix.AT_FDCWD, path,
+			unix.AT_SYMLINK_FOLLOW)
+		if err != nil {
+			err = &os.LinkError{
+				Op:  "link",
+				Old: t.temp.Name(),
+				New: path,
+				Err: err,
+			}
+		}
+	} else if t.temp.Name() != path {
+		err = os.Rename(t.temp.Name(), path)
+	}
+	if err != nil {
+		// Allow Cleanup to remove it.
+		return err
+	}
+	err = t.temp.Close()
+	t.temp = nil // Prevent cleanup removing it.
+	return err
+}
+
+// Truncate discards all content written so far.
+func (t *TempFile) Truncate() error {
+	if err := t.temp.Truncate(0); err != nil {
+		return err
+	}
+	_, err := t.temp.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is one of the upstream URLs (mirrors) of a repo.
+//
+// Mirrors are tried in order they were specified, but healthy ones first.
+// Mirror is marked unhealthy after a connection error or 5xx response
+// (passive check), and healthy again after successful request, including
+// periodic active check.
+type upstream struct {
+	reponame string
+	base     string
+	// nil if disabled.
+	breaker *circuitBreaker
+
+	mu        sync.Mutex
+	healthy   bool
+	lastError string
+	changed   time.Time
+	// False if hostname could not be resolved on last try.
+	resolved bool
+}
+
+func newUpstream(reponame, base string) *upstream {
+	u := &upstream{
+		reponame: reponame,
+		base:     base,
+		healthy:  true,
+		changed:  time.Now(),
+		resolved: true,
+	}
+	upstream_healthy.WithLabelValues(reponame, base).Set(1)
+	upstream_resolved.WithLabelValues(reponame, base).Set(1)
+	return u
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+func (u *upstream) markSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.healthy {
+		log.Printf("upstream: %s %q is healthy again", u.reponame, u.base)
+		u.healthy = true
+		u.changed = time.Now()
+		upstream_healthy.WithLabelValues(u.reponame, u.base).Set(1)
+	}
+}
+
+func (u *upstream) markFailure(reason string) {
+	upstream_failure_count.WithLabelValues(u.reponame, u.base).Inc()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastError = reason
+	if u.healthy {
+		log.Printf("upstream: %s %q marked unhealthy: %s", u.reponame, u.base, reason)
+		u.healthy = false
+		u.changed = time.Now()
+		upstream_healthy.WithLabelValues(u.reponame, u.base).Set(0)
+	}
+}
+
+// upstreamOrder returns mirrors in order to try them. Healthy ones first,
+// and then unhealthy ones (they might have recovered since last check).
+func (repo *Repo) upstreamOrder() []*upstream {
+	order := make([]*upstream, 0, len(repo.upstreams))
+	for _, u := range repo.upstreams {
+		if u.isHealthy() {
+			order = append(order, u)
+		}
+	}
+	for _, u := range repo.upstreams {
+		if !u.isHealthy() {
+			order = append(order, u)
+		}
+	}
+	return order
+}
+
+// doUpstream makes a request for filename to upstream, failing over to the
+// next mirror on connection errors and 5xx responses. prepare, if not nil,
+// is called to add headers to each request. Response (or error) of the last
+// tried mirror is returned.
+func (repo *Repo) doUpstream(method, filename string, prepare func(req *http.Request)) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	// Previously tried mirror, which failed.
+	var failed *upstream
+	for _, u := range repo.upstreamOrder() {
+		// Only just before trying the mirror, as allow starts a half-open
+		// probe, which must be recorded.
+		if !u.breaker.allow() {
+			continue
+		}
+		if failed != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			upstream_failover_count.Inc()
+			log.Printf("upstream: %s %s/%s failed on %q, trying next mirror %q", method, u.reponame, filename, failed.base, u.base)
+		}
+		var req *http.Request
+		req, err = repo.newUpstreamRequest(method, u.base+filename)
+		if err != nil {
+			u.breaker.record(false)
+			return nil, err
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+		resp, err = repo.client.Do(req)
+		if errors.Is(err, errRedirectRejected) {
+			// Mirror itself is fine, trying other mirrors would not help.
+			u.breaker.record(true)
+			u.markSuccess()
+			return nil, err
+		}
+		if err == nil && resp.StatusCode < 500 {
+			u.breaker.record(true)
+			u.markSuccess()
+			return resp, nil
+		}
+		u.breaker.record(false)
+		if err != nil {
+			u.markFailure(err.Error())
+		} else {
+			u.markFailure(http.StatusText(resp.StatusCode))
+		}
+		failed = u
+	}
+	if failed == nil {
+		circuit_rejected_count.Inc()
+		return nil, errCircuitOpen
+	}
+	return resp, err
+}
+
+// upstreamURL is URL of filename on the first (primary) mirror. Used to
+// identify the file, i.e. for resuming partial downloads.
+func (repo *Repo) upstreamURL(filename string) string {
+	return repo.upstreams[0].base + filename
+}
+
+// checkUpstreams actively checks health of all mirrors of the repo, by
+// requesting the base URL. Any response other than 5xx is fine.
+func (repo *Repo) checkUpstreams() {
+	client := http.Client{
+		Transport: repo.client.Transport,
+		// Redirect is a response too.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 30 * time.Second,
+	}
+	for _, u := range repo.upstreams {
+		req, err := repo.newUpstreamRequest(http.MethodHead, u.base)
+		if err != nil {
+			u.markFailure(err.Error())
+			continue
+		}
+		req.Header.Set("User-Agent", "nexus-proxy")
+		resp, err := client.Do(req)
+		if err != nil {
+			u.markFailure(err.Error())
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			u.markFailure(http.StatusText(resp.StatusCode))
+			continue
+		}
+		u.markSuccess()
+	}
+}
+
+func (u *upstream) isResolved() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.resolved
+}
+
+// resolveUpstreams checks that hostnames of all upstream URLs of the repo
+// can be resolved. Unresolvable ones are marked unhealthy. Upstreams
+// reached via proxy are not checked, as the proxy resolves them.
+func (repo *Repo) resolveUpstreams() {
+	for _, u := range repo.upstreams {
+		parsed, err := url.Parse(u.base)
+		if err != nil {
+			continue
+		}
+		if proxyURL, err := repo.proxy(&http.Request{URL: parsed}); err == nil && proxyURL != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, parsed.Hostname())
+		cancel()
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("Resolving hostname gave 0 addresses")
+		}
+
+		u.mu.Lock()
+		wasResolved := u.resolved
+		u.resolved = err == nil
+		u.mu.Unlock()
+		if err != nil {
+			upstream_resolved.WithLabelValues(u.reponame, u.base).Set(0)
+			upstream_resolve_error_count.Inc()
+			if wasResolved {
+				log.Printf("upstream: %s %q Could not resolve hostname. Error: %v", u.reponame, u.base, err)
+			}
+			u.markFailure(err.Error())
+			continue
+		}
+		upstream_resolved.WithLabelValues(u.reponame, u.base).Set(1)
+		if !wasResolved {
+			log.Printf("upstream: %s %q Hostname resolved", u.reponame, u.base)
+			// Was unhealthy because of DNS only, as far as we know.
+			u.markSuccess()
+		}
+	}
+}
+
+// Set after the first resolveUpstreams of all repos finished. Until then
+// upstreams are not known to be resolvable, see readyHandler.
+var upstreamsResolved atomic.Bool
+
+// startResolveLoop resolves upstream hostnames now, and then periodically.
+func startResolveLoop(repos map[string]*Repo, interval time.Duration) chan bool {
+	stop := make(chan bool, 1)
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			for _, repo := range repos {
+				if repo.offline {
+					continue
+				}
+				repo.resolveUpstreams()
+			}
+			upstreamsResolved.Store(true)
+			if tick == nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-tick:
+			}
+		}
+	}()
+	return stop
+}
+
+func startHealthCheckLoop(repos map[string]*Repo, interval time.Duration) chan bool {
+	stop := make(chan bool, 1)
+	if interval <= 0 {
+		return stop
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for _, repo := range repos {
+				if repo.offline {
+					continue
+				}
+				repo.checkUpstreams()
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// upstreamAuth are credentials used for requests to upstream (cache fills
+// and prefetch listing).
+//
+// Credentials are not passed on command line (where they would be visible
+// to other users in the process list), but loaded from a file or an
+// environment variable, with content like:
+//
+//	# One of basic, bearer or nexus-token:
+//	basic USER:PASSWORD
+//	bearer TOKEN
+//	nexus-token NAME_CODE:PASS_CODE
+//	# Any number of extra headers:
+//	header X-Api-Key: SECRET
+type upstreamAuth struct {
+	// Value of Authorization header, if any.
+	authorization string
+	headers       http.Header
+}
+
+// loadUpstreamAuth loads credentials from source, which is file:PATH or
+// env:VARIABLE.
+func loadUpstreamAuth(source string) (*upstreamAuth, error) {
+	data, err := loadSecret(source)
+	if err != nil {
+		return nil, err
+	}
+	return parseUpstreamAuth(data)
+}
+
+// loadSecret loads content of file:PATH or env:VARIABLE source.
+func loadSecret(source string) (string, error) {
+	kind, location, _ := strings.Cut(source, ":")
+	switch kind {
+	case "file":
+		content, err := os.ReadFile(location)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	case "env":
+		value, ok := os.LookupEnv(location)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %q not set", location)
+		}
+		return value, nil
+	default:
+		return "", errors.New("Credentials source must be file:PATH or env:VARIABLE")
+	}
+}
+
+func parseUpstreamAuth(data string) (*upstreamAuth, error) {
+	auth := &upstreamAuth{
+		headers: make(http.Header),
+	}
+	for lineNumber, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if len(value) == 0 {
+			return nil, fmt.Errorf("Line %d: Missing value", lineNumber+1)
+		}
+		switch kind {
+		case "basic", "nexus-token":
+			// Nexus user tokens are used just like username and password.
+			if auth.authorization != "" {
+				return nil, fmt.Errorf("Line %d: Only one of basic, bearer or nexus-token can be used", lineNumber+1)
+			}
+			if !strings.Contains(value, ":") {
+				return nil, fmt.Errorf("Line %d: Must be in form of USER:PASSWORD", lineNumber+1)
+			}
+			auth.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+		case "bearer":
+			if auth.authorization != "" {
+				return nil, fmt.Errorf("Line %d: Only one of basic, bearer or nexus-token can be used", lineNumber+1)
+			}
+			auth.authorization = "Bearer " + value
+		case "header":
+			name, headerValue, good := strings.Cut(value, ":")
+			name = strings.TrimSpace(name)
+			if !good || len(name) == 0 || strings.ContainsAny(name, " \t") {
+				return nil, fmt.Errorf("Line %d: Must be in form of header NAME: VALUE", lineNumber+1)
+			}
+			auth.headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(headerValue))
+		default:
+			return nil, fmt.Errorf("Line %d: Unknown credentials type %q", lineNumber+1, kind)
+		}
+	}
+	if auth.authorization == "" && len(auth.headers) == 0 {
+		return nil, errors.New("No credentials found")
+	}
+	return auth, nil
+}
+
+func (auth *upstreamAuth) apply(req *http.Request) {
+	if auth == nil {
+		return
+	}
+	if auth.authorization != "" {
+		req.Header.Set("Authorization", auth.authorization)
+	}
+	for name, values := range auth.headers {
+		req.Header[name] = values
+	}
+}
+
+// remove removes credentials from the request, i.e. when redirected to
+// another host.
+func (auth *upstreamAuth) remove(req *http.Request) {
+	if auth == nil {
+		return
+	}
+	req.Header.Del("Authorization")
+	for name := range auth.headers {
+		req.Header.Del(name)
+	}
+}
+
+// newUpstreamRequest creates a request to upstream of the repo, with
+// credentials if configured.
+func (repo *Repo) newUpstreamRequest(method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	repo.auth.apply(req)
+	return req, nil
+}
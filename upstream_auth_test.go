@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseUpstreamAuth(t *testing.T) {
+	tests := []struct {
+		data          string
+		authorization string
+		headers       http.Header
+		err           bool
+	}{
+		{data: "basic user:pass", authorization: "Basic dXNlcjpwYXNz", headers: http.Header{}},
+		{data: "nexus-token abc:d:ef\n", authorization: "Basic YWJjOmQ6ZWY=", headers: http.Header{}},
+		{data: "# comment\n\nbearer  tok3n \n", authorization: "Bearer tok3n", headers: http.Header{}},
+		{
+			data:    "header x-api-key: secret\nheader X-Other:a b",
+			headers: http.Header{"X-Api-Key": {"secret"}, "X-Other": {"a b"}},
+		},
+		{
+			data:          "bearer t\nheader X-Tenant: 1",
+			authorization: "Bearer t",
+			headers:       http.Header{"X-Tenant": {"1"}},
+		},
+		{data: "", err: true},
+		{data: "# only comment", err: true},
+		{data: "basic user", err: true},
+		{data: "basic", err: true},
+		{data: "basic a:b\nbearer t", err: true},
+		{data: "header NoColon", err: true},
+		{data: "header Bad Name: v", err: true},
+		{data: "digest a:b", err: true},
+	}
+	for _, test := range tests {
+		auth, err := parseUpstreamAuth(test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseUpstreamAuth(%q) = %+v, want error", test.data, auth)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUpstreamAuth(%q) error: %v", test.data, err)
+			continue
+		}
+		if auth.authorization != test.authorization || !reflect.DeepEqual(auth.headers, test.headers) {
+			t.Errorf("parseUpstreamAuth(%q) = %q %v, want %q %v", test.data, auth.authorization, auth.headers, test.authorization, test.headers)
+		}
+	}
+}
+
+func TestUpstreamAuthApply(t *testing.T) {
+	auth, err := parseUpstreamAuth("bearer t\nheader X-Tenant: 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept", "*/*")
+	auth.apply(req)
+	if req.Header.Get("Authorization") != "Bearer t" || req.Header.Get("X-Tenant") != "1" {
+		t.Errorf("apply() headers %v", req.Header)
+	}
+	var none *upstreamAuth
+	none.apply(req)
+}
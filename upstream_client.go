@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// newUpstreamClient creates HTTP client for requests to upstream of a repo.
+// It is shared by cache misses, revalidation and the prefetcher.
+// If proxy is nil, proxy from environment variables (HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY) is used. Server name and pins of tlsConfig
+// apply only to connections to host (host:port, see tlsHost).
+func newUpstreamClient(option UpstreamClientOption, tlsConfig *tls.Config, host string, proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	transport.DialContext = (&net.Dialer{
+		Timeout:   option.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = option.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = option.ResponseHeaderTimeout
+	transport.MaxConnsPerHost = option.MaxConnsPerHost
+	if option.MaxConnsPerHost > 0 && transport.MaxIdleConnsPerHost < option.MaxConnsPerHost {
+		transport.MaxIdleConnsPerHost = option.MaxConnsPerHost
+	}
+	var hostTransport http.RoundTripper
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+		if tlsConfig.ServerName != "" || tlsConfig.VerifyConnection != nil {
+			// Separate connection pool, so connections are never reused
+			// across the configurations.
+			hostTransport = transport
+			transport = transport.Clone()
+			transport.TLSClientConfig = withoutHostTLS(tlsConfig)
+		}
+	}
+	return &http.Client{
+		Transport: &upstreamTransport{
+			transport:       transport,
+			idleBodyTimeout: option.IdleBodyTimeout,
+			retries:         option.Retries,
+			retryBackoff:    option.RetryBackoff,
+			maxBackoff:      option.MaxBackoff,
+			host:            host,
+			hostTransport:   hostTransport,
+		},
+	}
+}
+
+// upstreamTransport retries failed idempotent requests, and aborts
+// responses that stop sending data.
+//
+// Retries are done before the response is returned, so before any bytes
+// reach the client.
+type upstreamTransport struct {
+	transport       http.RoundTripper
+	idleBodyTimeout time.Duration
+	retries         int
+	retryBackoff    time.Duration
+	maxBackoff      time.Duration
+	// Used instead of transport for requests to host, if not nil.
+	host          string
+	hostTransport http.RoundTripper
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil
+	for attempt := 0; ; attempt++ {
+		resp, err := t.roundTrip(req)
+		if !idempotent || attempt >= t.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if !isRetryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, BUFFERSIZE))
+			resp.Body.Close()
+		}
+		// Jitter, so many clients do not retry at the same time.
+		backoff := t.backoff(attempt)
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		upstream_retry_count.Inc()
+		if err != nil {
+			log.Printf("upstream: %s %q failed, retrying in %v. Error: %v", req.Method, req.URL.Redacted(), backoff, err)
+		} else {
+			log.Printf("upstream: %s %q responded with status %d, retrying in %v", req.Method, req.URL.Redacted(), resp.StatusCode, backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff returns exponential backoff before retry after the attempt,
+// without jitter, at most maxBackoff.
+func (t *upstreamTransport) backoff(attempt int) time.Duration {
+	backoff := t.retryBackoff
+	for i := 0; i < attempt && backoff < t.maxBackoff; i++ {
+		if backoff > t.maxBackoff/2 {
+			return t.maxBackoff
+		}
+		backoff *= 2
+	}
+	return min(backoff, t.maxBackoff)
+}
+
+func (t *upstreamTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if t.hostTransport != nil && tlsHost(req.URL) == t.host {
+		transport = t.hostTransport
+	}
+	if t.idleBodyTimeout <= 0 {
+		return transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &idleTimeoutBody{
+		body:    resp.Body,
+		cancel:  cancel,
+		timeout: t.idleBodyTimeout,
+	}
+	body.timer = time.AfterFunc(t.idleBodyTimeout, body.expire)
+	// Only time waiting for upstream counts, not time spent by the caller
+	// between reads (i.e. sending data to a slow client).
+	body.timer.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+var errIdleBodyTimeout = errors.New("Upstream stopped sending data (idle timeout)")
+
+// idleTimeoutBody aborts the response, if a read did not receive any data
+// for the timeout. Unlike http.Client.Timeout, it does not limit duration of
+// the whole (possibly very big) download.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.mu.Lock()
+	b.expired = true
+	b.mu.Unlock()
+	upstream_idle_timeout_count.Inc()
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		expired := b.expired
+		b.mu.Unlock()
+		if expired {
+			return n, errIdleBodyTimeout
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamTransportBackoff(t *testing.T) {
+	tests := []struct {
+		retryBackoff, maxBackoff time.Duration
+		attempt                  int
+		want                     time.Duration
+	}{
+		{500 * time.Millisecond, 30 * time.Second, 0, 500 * time.Millisecond},
+		{500 * time.Millisecond, 30 * time.Second, 3, 4 * time.Second},
+		{500 * time.Millisecond, 30 * time.Second, 6, 30 * time.Second},
+		// Does not overflow.
+		{500 * time.Millisecond, 30 * time.Second, 100, 30 * time.Second},
+		{time.Second, 1<<63 - 1, 100, 1<<63 - 1},
+		{0, 30 * time.Second, 5, 0},
+		{0, 0, 5, 0},
+	}
+	for _, test := range tests {
+		transport := &upstreamTransport{retryBackoff: test.retryBackoff, maxBackoff: test.maxBackoff}
+		if got := transport.backoff(test.attempt); got != test.want {
+			t.Errorf("backoff(%d) with retry_backoff=%s, max_backoff=%s = %s, want %s", test.attempt, test.retryBackoff, test.maxBackoff, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// noProxyRule is a single entry of NO_PROXY style exclusion list.
+type noProxyRule struct {
+	all    bool
+	ipNet  *net.IPNet
+	ip     net.IP
+	domain string
+	// Empty matches any port.
+	port string
+}
+
+// parseNoProxy parses comma separated list of hosts that should be
+// connected to directly, not via proxy. Entries are:
+//
+//   - "*" matches all hosts,
+//   - IP address, or network in CIDR notation (i.e. 10.0.0.0/8),
+//   - domain name, matching also all subdomains. Leading "." or "*." is
+//     optional,
+//
+// and optionally ":PORT" suffix, to only match connections to that port.
+func parseNoProxy(list string) ([]noProxyRule, error) {
+	var rules []noProxyRule
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if len(entry) == 0 {
+			continue
+		}
+		if entry == "*" {
+			rules = append(rules, noProxyRule{all: true})
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			rules = append(rules, noProxyRule{ipNet: ipNet})
+			continue
+		}
+		var rule noProxyRule
+		host := entry
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			host, rule.port = h, port
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			rule.ip = ip
+		} else {
+			host = strings.TrimPrefix(host, "*")
+			host = strings.TrimPrefix(host, ".")
+			if len(host) == 0 || strings.ContainsAny(host, "/*[]") {
+				return nil, fmt.Errorf("Invalid no proxy entry %q", entry)
+			}
+			rule.domain = host
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchNoProxy returns true, if connection to host and port should not use
+// proxy.
+func matchNoProxy(rules []noProxyRule, host, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, rule := range rules {
+		if rule.all {
+			return true
+		}
+		if rule.port != "" && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.ipNet != nil:
+			if ip != nil && rule.ipNet.Contains(ip) {
+				return true
+			}
+		case rule.ip != nil:
+			if ip != nil && rule.ip.Equal(ip) {
+				return true
+			}
+		default:
+			if host == rule.domain || strings.HasSuffix(host, "."+rule.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newUpstreamProxy returns function to select proxy for upstream requests,
+// for use in http.Transport.
+func newUpstreamProxy(proxyURL *url.URL, noProxy []noProxyRule) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		port := req.URL.Port()
+		if port == "" {
+			port = "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+		}
+		if matchNoProxy(noProxy, req.URL.Hostname(), port) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
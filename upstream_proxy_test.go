@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseNoProxy(t *testing.T) {
+	for _, list := range []string{"foo/bar", "a*b.com", "[::1", "*.", "."} {
+		if _, err := parseNoProxy(list); err == nil {
+			t.Errorf("parseNoProxy(%q), want error", list)
+		}
+	}
+	if rules, err := parseNoProxy(" , "); err != nil || len(rules) != 0 {
+		t.Errorf("parseNoProxy of empty entries = %v, %v", rules, err)
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	tests := []struct {
+		list       string
+		host, port string
+		want       bool
+	}{
+		{"", "example.com", "443", false},
+		{"*", "example.com", "443", true},
+		{"example.com", "example.com", "443", true},
+		{"example.com", "nexus.EXAMPLE.com.", "80", true},
+		{"example.com", "badexample.com", "443", false},
+		{".example.com", "example.com", "443", true},
+		{"*.example.com", "a.b.example.com", "443", true},
+		{"example.com:8443", "example.com", "8443", true},
+		{"example.com:8443", "example.com", "443", false},
+		{"10.0.0.0/8", "10.1.2.3", "80", true},
+		{"10.0.0.0/8", "11.1.2.3", "80", false},
+		{"10.0.0.0/8", "ten.example.com", "80", false},
+		{"192.168.1.1", "192.168.1.1", "80", true},
+		{"192.168.1.1:81", "192.168.1.1", "80", false},
+		{"::1", "::1", "80", true},
+		{"[::1]:8081", "::1", "8081", true},
+		{"fd00::/8", "fd12::1", "443", true},
+		{"a.com, b.com ,10.0.0.1", "b.com", "443", true},
+	}
+	for _, test := range tests {
+		rules, err := parseNoProxy(test.list)
+		if err != nil {
+			t.Errorf("parseNoProxy(%q) error: %v", test.list, err)
+			continue
+		}
+		if got := matchNoProxy(rules, test.host, test.port); got != test.want {
+			t.Errorf("matchNoProxy(%q, %q, %q) = %v, want %v", test.list, test.host, test.port, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamProxyDefaultPorts(t *testing.T) {
+	proxyURL, _ := url.Parse("http://egress:3128")
+	rules, _ := parseNoProxy("plain.com:80,secure.com:443")
+	proxy := newUpstreamProxy(proxyURL, rules)
+	tests := []struct {
+		url    string
+		direct bool
+	}{
+		{"http://plain.com/x", true},
+		{"https://plain.com/x", false},
+		{"https://secure.com/x", true},
+		{"https://secure.com:8443/x", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+		got, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != test.direct {
+			t.Errorf("Proxy for %q = %v, want direct %v", test.url, got, test.direct)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// newUpstreamTLSConfig creates TLS configuration for requests to upstream
+// of a repo. CA bundle, client certificate and key are loaded from files
+// once at startup. ServerName and pins are only for the upstream host, see
+// withoutHostTLS.
+func newUpstreamTLSConfig(option UpstreamTLSOption) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: option.ServerName,
+	}
+	if option.MinVersion != 0 {
+		config.MinVersion = option.MinVersion
+	}
+	if option.CAFile != "" {
+		pem, err := os.ReadFile(option.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		// Only the custom CA bundle is trusted, not the system roots.
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %q", option.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if option.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(option.CertFile, option.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(option.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range option.Pins {
+			pins[pin] = true
+		}
+		// Called after the normal certificate verification, so pinning is an
+		// additional check, not a replacement for it.
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+					return nil
+				}
+			}
+			upstream_tls_pin_error_count.Inc()
+			return errors.New("No upstream certificate matches pinned public keys")
+		}
+	}
+	return config, nil
+}
+
+// withoutHostTLS returns TLS configuration for hosts other than the upstream
+// host (other mirrors, redirect targets), without options specific to the
+// upstream host: server name and pins.
+func withoutHostTLS(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.ServerName = ""
+	config.VerifyConnection = nil
+	return config
+}
+
+// tlsHost returns host and port of the URL, as used to select TLS
+// configuration of a connection.
+func tlsHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
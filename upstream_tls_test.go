@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLSPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name   string
+		option UpstreamTLSOption
+		ok     bool
+	}{
+		{"system roots", UpstreamTLSOption{}, false},
+		{"custom CA", UpstreamTLSOption{CAFile: caFile}, true},
+		{"matching pin", UpstreamTLSOption{CAFile: caFile, Pins: []string{otherPin, pin}}, true},
+		{"other pin", UpstreamTLSOption{CAFile: caFile, Pins: []string{otherPin}}, false},
+	}
+	for _, test := range tests {
+		config, err := newUpstreamTLSConfig(test.option)
+		if err != nil {
+			t.Fatalf("%s: newUpstreamTLSConfig error: %v", test.name, err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: request error %v, want success %v", test.name, err, test.ok)
+		}
+	}
+
+	if _, err := newUpstreamTLSConfig(UpstreamTLSOption{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Errorf("newUpstreamTLSConfig with missing CA bundle, want error")
+	}
+}
+
+// Server name and pins apply only to the upstream host, not to other
+// mirrors or redirect targets.
+func TestUpstreamTLSHostOnly(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	upstream := httptest.NewTLSServer(handler)
+	defer upstream.Close()
+	mirror := httptest.NewTLSServer(handler)
+	defer mirror.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	upstreamURL, _ := url.Parse(upstream.URL)
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	clientOption := defaultUpstreamClientOption()
+	clientOption.Retries = 0
+
+	for _, option := range []UpstreamTLSOption{
+		{CAFile: caFile, ServerName: "other.invalid"},
+		{CAFile: caFile, Pins: []string{otherPin}},
+	} {
+		config, err := newUpstreamTLSConfig(option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := newUpstreamClient(clientOption, config, tlsHost(upstreamURL), nil)
+		if resp, err := client.Get(upstream.URL); err == nil {
+			resp.Body.Close()
+			t.Errorf("%+v: request to upstream host succeeded, want error", option)
+		}
+		resp, err := client.Get(mirror.URL)
+		if err != nil {
+			t.Errorf("%+v: request to other host error: %v", option, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files for which upstream response has Vary header (naming some of the
+// forwarded request headers, see --forward_request_headers) can have
+// multiple variants in the cache. They are stored as
+//
+//	cache/REPO/final/FILENAME.nexus_proxy_vary/vary
+//	cache/REPO/final/FILENAME.nexus_proxy_vary/KEY
+//
+// where vary lists names of the headers (one per line), and KEY is a hash
+// of values of these headers in the request. Variant is used as FILENAME
+// (relative to final/) for metadata, so sidecar metadata files work too.
+const varyDirSuffix = ".nexus_proxy_vary"
+
+func varyDir(reponame, filename string) string {
+	return "cache/" + reponame + "/final/" + filename + varyDirSuffix
+}
+
+func variantFilename(filename, key string) string {
+	return filename + varyDirSuffix + "/" + key
+}
+
+// variantOf returns filename of which the cached filename (relative to
+// final/) is a variant, or filename itself.
+func variantOf(filename string) string {
+	if i := strings.Index(filename, varyDirSuffix+"/"); i >= 0 {
+		return filename[:i]
+	}
+	return filename
+}
+
+// varyNames returns sorted names of headers in Vary upstream response
+// header, which are forwarded to upstream. Other headers are never sent
+// to upstream, so they cannot influence the response. star is true for
+// "Vary: *", which means the response cannot be reused at all.
+func (repo *Repo) varyNames(header http.Header) (names []string, star bool) {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, true
+			}
+			for _, forwarded := range repo.forwardRequestHeaders {
+				if name == forwarded {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// varyKey returns key of a variant selected by values of forwarded request
+// headers.
+func varyKey(names []string, forward http.Header) string {
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name + ": " + strings.Join(forward.Values(name), ", ") + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readVaryNames returns names of headers selecting variants, stored in the
+// variants directory dir, if the file has variants.
+func readVaryNames(dir string) ([]string, bool) {
+	data, err := os.ReadFile(dir + "/vary")
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(string(data)), true
+}
+
+// lookupVariant returns filename (relative to final/) of a variant of the
+// file matching forwarded request headers, if the file has variants.
+func lookupVariant(reponame, filename string, forward http.Header) (string, bool) {
+	names, ok := readVaryNames(varyDir(reponame, filename))
+	if !ok {
+		return "", false
+	}
+	return variantFilename(filename, varyKey(names, forward)), true
+}
+
+// fetchServes checks if the response of the fetch can be served to a client
+// with the forwarded request headers. Until variants of a file are known,
+// all requests for it share a fetch (see fetchKey), but the response can
+// turn out to be a variant selected by headers which differ.
+func (repo *Repo) fetchServes(f *fetch, forward http.Header) bool {
+	names := f.varyNames
+	if f.varyStar {
+		names = repo.forwardRequestHeaders
+	}
+	return varyKey(names, forward) == varyKey(names, f.forward)
+}
+
+// setVaryHeader sets Vary response header for clients, so their caches do
+// not reuse a variant for requests selecting another one.
+func setVaryHeader(header http.Header, names []string, star bool) {
+	if star {
+		header.Set("Vary", "*")
+	} else if len(names) > 0 {
+		header.Set("Vary", strings.Join(names, ", "))
+	}
+}
+
+// storeVaryNames records names of headers selecting variants of the file.
+// If they changed, existing variants are removed, as they cannot be found
+// anymore.
+func storeVaryNames(reponame, filename string, names []string) error {
+	dir := varyDir(reponame, filename)
+	content := strings.Join(names, "\n") + "\n"
+	existing, err := os.ReadFile(dir + "/vary")
+	if err == nil && string(existing) == content {
+		// Keep it from being garbage collected while variants are in use.
+		now := time.Now()
+		return os.Chtimes(dir+"/vary", now, now)
+	}
+	if err == nil {
+		os.RemoveAll(dir)
+	}
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	temp := dir + "/vary." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err = os.WriteFile(temp, []byte(content), 0640); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, dir+"/vary")
+}
+
+// removeUnusedVary removes variants directory of the file, if no variants
+// are left in it (only vary). Fetches storing a variant hold dirMu, so it is
+// not removed under them.
+func (repo *Repo) removeUnusedVary(reponame, filename string) {
+	dir := varyDir(reponame, filename)
+	repo.dirMu.Lock()
+	defer repo.dirMu.Unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != "vary" {
+			return
+		}
+	}
+	os.RemoveAll(dir)
+}
+
+// openCached opens cached file, or its variant matching forwarded request
+// headers. Returns also filename of the opened file, relative to final/.
+func openCached(reponame, filename string, forward http.Header) (*os.File, string, error) {
+	cache, err := os.Open("cache/" + reponame + "/final/" + filename)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return cache, filename, err
+	}
+	variant, ok := lookupVariant(reponame, filename, forward)
+	if !ok {
+		return nil, filename, err
+	}
+	cache, err = os.Open("cache/" + reponame + "/final/" + variant)
+	return cache, variant, err
+}